@@ -4,6 +4,7 @@ const (
 	// Common config
 	ClientID    = "client_id"     // Client ID
 	Servers     = "servers"       // Comma-separated list of brokers servers
+	URL         = "url"           // broker URL with the credentials and the other options as query parameters
 	Timeout     = "timeout"       // timeout in milliseconds
 	KeepAlive   = "keep_alive"    // Keep alive
 	Username    = "username"      // username to connect to broker
@@ -14,11 +15,66 @@ const (
 	Insecure    = "insecure"      // TLS: Insecure skip TLS verification
 	Storage     = "storage"       // Path to a directory to persist client data (for QoS 1 and 2)
 	Logger      = "logger"        // Log errors to "stdout, stderr or file:/path/to/log.txt"
+	Connection  = "connection"    // name of the MQTT connection shared by the virtual tables
+
+	CertKeyPassword = "cert_key_password" // TLS: password of the encrypted certificate key or PKCS#12 bundle
+	TLSMinVersion   = "tls_min_version"   // TLS: minimum version, 1.0, 1.1, 1.2 or 1.3
+	TLSCiphers      = "tls_ciphers"       // TLS: comma-separated list of cipher suites
+	TLSServerName   = "tls_server_name"   // TLS: server name for SNI and certificate verification
+	TLSALPN         = "tls_alpn"          // TLS: comma-separated list of ALPN protocols
+	CertPEM         = "cert_pem"          // TLS: PEM certificate
+	CertKeyPEM      = "cert_key_pem"      // TLS: PEM certificate key
+	CAPEM           = "ca_pem"            // TLS: PEM CA certificates
+	CertFrom        = "cert_from"         // TLS: table:name of the row with the PEM options
+
+	WSHeaders   = "ws_headers"   // WebSocket: HTTP headers of the handshake as a JSON object
+	HTTPProxy   = "http_proxy"   // WebSocket: URL of the HTTP proxy
+	SOCKS5Proxy = "socks5_proxy" // WebSocket: address of the SOCKS5 proxy
+
+	UsernameFile        = "username_file"          // file with the username, re-read on every connection attempt
+	PasswordFile        = "password_file"          // file with the password, re-read on every connection attempt
+	CertKeyPasswordFile = "cert_key_password_file" // TLS: file with the password of the encrypted certificate key or PKCS#12 bundle
+
+	Profile       = "profile"        // name of the profile with the connection settings
+	ProfilesTable = "profiles_table" // table where the profiles are stored
+
+	ProtocolVersion = "protocol_version" // MQTT protocol version: 3.1, 3.1.1 (default) or 5
+	SessionExpiry   = "session_expiry"   // MQTT 5: session expiry interval in seconds
+
+	CleanSession         = "clean_session"          // start a clean session, discarding the session state kept by the broker
+	ResumeSubs           = "resume_subs"            // resume the stored subscriptions on reconnect (requires clean_session=false)
+	OrderMatters         = "order_matters"          // deliver the incoming messages in order, one at a time
+	ConnectRetry         = "connect_retry"          // retry the initial connection until the broker is reachable
+	ConnectRetryInterval = "connect_retry_interval" // time in milliseconds between the initial connection attempts
+	MaxReconnectInterval = "max_reconnect_interval" // maximum time in milliseconds between reconnection attempts
+	LazyConnect          = "lazy_connect"           // create the virtual table right away and connect in the background
+
+	WillTopic      = "will_topic"      // topic of the message published by the broker when the client drops
+	WillPayload    = "will_payload"    // payload of the will message
+	WillQoS        = "will_qos"        // QoS of the will message
+	WillRetained   = "will_retained"   // retain the will message
+	WillDelay      = "will_delay"      // MQTT 5: will delay interval in seconds
+	WillProperties = "will_properties" // MQTT 5: will user properties as a JSON object
+	BirthPayload   = "birth_payload"   // payload published to will_topic on every connection
+
+	// Publisher module config
+	OutboxTable     = "outbox_table"     // table used to store messages before delivering them to the broker
+	MaxAttempts     = "max_attempts"     // delivery attempts of an outbox message before it is marked as failed
+	OutboxRetention = "outbox_retention" // time in seconds the delivered messages are kept in the outbox table
 
 	// Subscribe module config
-	TableName = "table" // table name where to store the incoming messages
+	TableName = "table"    // table name where to store the incoming messages
+	Metadata  = "metadata" // store MQTT 5 message metadata columns in the table
+	Topics    = "topics"   // comma-separated list of topic:qos to subscribe on connect
+
+	BatchSize     = "batch_size"     // number of incoming messages written in a single transaction
+	BatchInterval = "batch_interval" // maximum time in milliseconds an incoming message waits to be written
+	QueueSize     = "queue_size"     // size of the queue between the MQTT client and the goroutine writing to the table
+	Overflow      = "overflow"       // what to do when the queue is full: block, drop_oldest, drop_newest or spill_to_disk
+	Ack           = "ack"            // when to acknowledge incoming messages: auto (default) or after_commit
 
 	DefaultTableName          = "mqtt_data"
+	DefaultProfilesTable      = "mqtt_profiles"
 	DefaultPublisherVTabName  = "mqtt_pub"
 	DefaultSubscriberVTabName = "mqtt_sub"
 )
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOptionsRegistry(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, o := range Options {
+		if seen[o.Name] {
+			t.Errorf("option %q registered twice", o.Name)
+		}
+		seen[o.Name] = true
+		if !slices.Contains([]string{TypeText, TypeInteger, TypeBoolean, TypeList, TypeJSON}, o.Type) {
+			t.Errorf("option %q has unknown type %q", o.Name, o.Type)
+		}
+		if len(o.Modules) == 0 {
+			t.Errorf("option %q is not supported by any module", o.Name)
+		}
+		if o.Description == "" {
+			t.Errorf("option %q has no description", o.Name)
+		}
+		if o.Default != "" {
+			if err := o.Check(o.Default); err != nil {
+				t.Errorf("default of option %q: %v", o.Name, err)
+			}
+		}
+	}
+}
+
+func TestLookupOption(t *testing.T) {
+	o, ok := LookupOption(BatchSize)
+	if !ok || o.Name != BatchSize {
+		t.Fatalf("LookupOption(%q) = %v, %v", BatchSize, o, ok)
+	}
+	if !o.SupportedBy(DefaultSubscriberVTabName) || o.SupportedBy(DefaultPublisherVTabName) {
+		t.Errorf("%q supported by %q, want only the subscriber", o.Name, o.Modules)
+	}
+	if _, ok := LookupOption("no_such_option"); ok {
+		t.Error("found an unregistered option")
+	}
+}
+
+func TestOptionCheck(t *testing.T) {
+	tests := []struct {
+		typ     string
+		value   string
+		wantErr string
+	}{
+		{typ: TypeInteger, value: "-12"},
+		{typ: TypeInteger, value: "1.5", wantErr: `"1.5" is not a valid integer`},
+		{typ: TypeBoolean, value: "true"},
+		{typ: TypeBoolean, value: "0"},
+		{typ: TypeBoolean, value: "yes", wantErr: `"yes" is not a valid boolean`},
+		{typ: TypeText, value: "anything"},
+		{typ: TypeList, value: "a,b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+"/"+tt.value, func(t *testing.T) {
+			err := Option{Name: "opt", Type: tt.typ}.Check(tt.value)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Session holds the session control options shared by the publisher and the subscriber modules.
+// Their defaults are in the option registry.
+type Session struct {
+	CleanSession         bool
+	ResumeSubs           bool
+	OrderMatters         bool
+	ConnectRetry         bool
+	ConnectRetryInterval time.Duration
+	MaxReconnectInterval time.Duration
+	LazyConnect          bool
+}
+
+// Set parses the value of a session option. It returns false if the key is not a session option.
+func (s *Session) Set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case CleanSession:
+		s.CleanSession, err = strconv.ParseBool(value)
+	case ResumeSubs:
+		s.ResumeSubs, err = strconv.ParseBool(value)
+	case OrderMatters:
+		s.OrderMatters, err = strconv.ParseBool(value)
+	case ConnectRetry:
+		s.ConnectRetry, err = strconv.ParseBool(value)
+	case ConnectRetryInterval:
+		s.ConnectRetryInterval, err = parseInterval(value)
+	case MaxReconnectInterval:
+		s.MaxReconnectInterval, err = parseInterval(value)
+	case LazyConnect:
+		s.LazyConnect, err = strconv.ParseBool(value)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid %q option: %w", key, err)
+	}
+	return true, nil
+}
+
+// Validate checks the combination of the session options.
+func (s Session) Validate() error {
+	if s.ResumeSubs && s.CleanSession {
+		return fmt.Errorf("%q requires %s=false", ResumeSubs, CleanSession)
+	}
+	return nil
+}
+
+// parseInterval parses a positive number of milliseconds.
+func parseInterval(v string) (time.Duration, error) {
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if i <= 0 {
+		return 0, fmt.Errorf("must be a positive number of milliseconds")
+	}
+	return time.Duration(i) * time.Millisecond, nil
+}
@@ -0,0 +1,176 @@
+package extension_test
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	_ "github.com/litesql/mqtt/extension/loader"
+)
+
+// newBroker starts an in-process broker listening on a free TCP port, returning
+// the broker and its address.
+func newBroker(t *testing.T) (*broker, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	return startBroker(t, listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})), addr
+}
+
+// startBroker starts an in-process broker accepting every client on the listeners.
+// It is closed when the test ends, after the databases opened afterwards.
+func startBroker(t *testing.T, ls ...listeners.Listener) *broker {
+	t.Helper()
+	s := newServer(t)
+	serve(t, s, ls...)
+	return s
+}
+
+// broker is an in-process broker, closed by the test or when the test ends.
+type broker struct {
+	*mqtt.Server
+	closeOnce sync.Once
+}
+
+func (b *broker) Close() {
+	b.closeOnce.Do(func() {
+		b.Server.Close()
+	})
+}
+
+// newServer returns a broker that is not listening yet, so that inline
+// subscriptions can be made before the first client connects.
+func newServer(t *testing.T) *broker {
+	t.Helper()
+	s := broker{
+		Server: mqtt.New(&mqtt.Options{
+			InlineClient: true,
+			Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		}),
+	}
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return &s
+}
+
+func serve(t *testing.T, s *broker, ls ...listeners.Listener) {
+	t.Helper()
+	for _, l := range ls {
+		if err := s.AddListener(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// openDB opens a connection to the database with the extension loaded, an
+// in-memory one when dsn is empty. It is closed when the test ends.
+func openDB(t *testing.T, dsn string) *sql.Conn {
+	t.Helper()
+	if dsn == "" {
+		dsn = ":memory:"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		db.Close()
+	})
+	return conn
+}
+
+func mustExec(t *testing.T, conn *sql.Conn, query string, args ...any) {
+	t.Helper()
+	if _, err := conn.ExecContext(context.Background(), query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func queryInt(t *testing.T, conn *sql.Conn, query string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := conn.QueryRowContext(context.Background(), query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// recorder collects the payloads the broker receives on a topic filter.
+type recorder struct {
+	mu       sync.Mutex
+	payloads []string
+}
+
+func record(t *testing.T, s *broker, filter string) *recorder {
+	t.Helper()
+	var r recorder
+	err := s.Subscribe(filter, 1, func(_ *mqtt.Client, _ packets.Subscription, pk packets.Packet) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.payloads = append(r.payloads, string(pk.Payload))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+func (r *recorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.payloads)
+}
+
+// waitUntil waits for the payload, returning the ones received before it.
+func (r *recorder) waitUntil(t *testing.T, payload string) []string {
+	t.Helper()
+	var received []string
+	waitFor(t, "payload "+payload, func() bool {
+		received = r.list()
+		return slices.Contains(received, payload)
+	})
+	return received[:slices.Index(received, payload)]
+}
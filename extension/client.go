@@ -0,0 +1,179 @@
+package extension
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/litesql/mqtt/config"
+)
+
+const (
+	protocolV31  = 3
+	protocolV311 = 4
+	protocolV5   = 5
+)
+
+var errNotConnected = errors.New("not connected to the broker")
+
+// client hides the differences between the MQTT 3.1.1 (paho.mqtt.golang) and
+// MQTT 5 (paho.golang) clients used by the virtual tables.
+type client interface {
+	Connect() error
+	Publish(msg *message) error
+	Subscribe(topic string, qos byte, handler messageHandler) error
+	Unsubscribe(topics ...string) error
+	Disconnect()
+	ClientID() string
+	IsConnected() bool
+	// ServerURL is the broker of the current, or last attempted, connection
+	ServerURL() string
+	// Certificate is the client certificate presented to the broker, nil without one
+	Certificate() *x509.Certificate
+}
+
+// message is an application message sent by a publisher or delivered to a subscription.
+type message struct {
+	messageID uint16
+	topic     string
+	payload   []byte
+	qos       byte
+	retained  bool
+	duplicate bool
+
+	// properties are only available on MQTT 5 connections
+	properties *messageProperties
+
+	// ack acknowledges an incoming message to the broker. It is only set
+	// when the client was created with manualAck.
+	ack func()
+}
+
+type messageProperties struct {
+	user            []userProperty
+	contentType     string
+	responseTopic   string
+	correlationData []byte
+	messageExpiry   *uint32
+	payloadFormat   *byte
+
+	// subscriptionIdentifier is only set on incoming messages
+	subscriptionIdentifier *int
+}
+
+type userProperty struct {
+	key   string
+	value string
+}
+
+type messageHandler func(msg *message)
+
+// clientConfig holds everything needed to create a client for either protocol version.
+type clientConfig struct {
+	protocolVersion uint
+	options         *mqtt.ClientOptions
+	storage         string
+	sessionExpiry   uint32
+	will            *will
+	// certs loads the client certificate, reloading it when renewed
+	certs *certLoader
+	// dial replaces the transports of the client for the servers with a registered dialer
+	dial Dialer
+	// lazyConnect connects in the background instead of failing when the broker is unreachable
+	lazyConnect bool
+	// manualAck disables the automatic acknowledgement of incoming messages
+	manualAck bool
+	// defaultHandler receives the messages matching no subscription, like the
+	// ones a persistent session delivers before the topics are subscribed again
+	defaultHandler messageHandler
+	// topics are subscribed once connected, the default handler of a shared
+	// client only receives the messages matching them or a subscription
+	topics []string
+
+	// connection names the client shared by the virtual tables, they share it by
+	// settings, the options not local to the virtual table, when empty
+	connection string
+	settings   string
+
+	onConnect        func()
+	onConnectionLost func(error)
+	// onConnectError receives the failed connection attempts, when the client reports them
+	onConnectError func(error)
+}
+
+func newClient(cfg clientConfig) (client, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.protocolVersion == protocolV5 {
+		return newClientV5(cfg)
+	}
+	return newClientV3(cfg), nil
+}
+
+func (cfg clientConfig) validate() error {
+	if cfg.protocolVersion == protocolV5 {
+		if cfg.options.ResumeSubs {
+			return fmt.Errorf("%q is not supported on MQTT 5 connections", config.ResumeSubs)
+		}
+		return nil
+	}
+	if cfg.sessionExpiry > 0 {
+		return errRequiresV5(config.SessionExpiry)
+	}
+	if cfg.will != nil && cfg.will.delay != nil {
+		return errRequiresV5(config.WillDelay)
+	}
+	if cfg.will != nil && cfg.will.properties != nil {
+		return errRequiresV5(config.WillProperties)
+	}
+	return nil
+}
+
+// connect establishes the first connection, in the background with lazyConnect.
+func connect(c client, cfg clientConfig, logger *slog.Logger, virtualTableName string) error {
+	if !cfg.lazyConnect {
+		if err := c.Connect(); err != nil {
+			return fmt.Errorf("connecting to mqtt server: %w", err)
+		}
+		return nil
+	}
+	go func() {
+		if err := c.Connect(); err != nil {
+			if cfg.onConnectError != nil {
+				cfg.onConnectError(err)
+			}
+			logger.Error("connecting to mqtt server", "virtual_table", virtualTableName, "error", err)
+		}
+	}()
+	return nil
+}
+
+func errRequiresV5(feature string) error {
+	return fmt.Errorf("%q requires an MQTT 5 connection, use %s=5", feature, config.ProtocolVersion)
+}
+
+func parseProtocolVersion(v string) (uint, error) {
+	switch v {
+	case "3", "3.1":
+		return protocolV31, nil
+	case "4", "3.1.1":
+		return protocolV311, nil
+	case "5", "5.0":
+		return protocolV5, nil
+	default:
+		return 0, fmt.Errorf("unsupported version %q, use 3.1, 3.1.1 or 5", v)
+	}
+}
+
+func parseSessionExpiry(v string) (uint32, error) {
+	i, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(i), nil
+}
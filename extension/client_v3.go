@@ -0,0 +1,152 @@
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// clientV3 is an MQTT 3.1/3.1.1 client backed by paho.mqtt.golang.
+type clientV3 struct {
+	client    mqtt.Client
+	servers   int
+	manualAck bool
+	serverURL atomic.Pointer[url.URL]
+	certs     *certLoader
+	// session counts the connection attempts, so that a message is only
+	// acknowledged on the connection it was received on
+	session atomic.Uint64
+}
+
+func newClientV3(cfg clientConfig) *clientV3 {
+	clientOptions := cfg.options
+	if cfg.protocolVersion != 0 {
+		clientOptions.SetProtocolVersion(cfg.protocolVersion)
+	}
+	if cfg.storage != "" {
+		clientOptions.SetStore(mqtt.NewFileStore(cfg.storage))
+	}
+	if w := cfg.will; w != nil {
+		clientOptions.SetBinaryWill(w.topic, w.payload, w.qos, w.retained)
+	}
+	if cfg.dial != nil {
+		clientOptions.SetCustomOpenConnectionFn(func(server *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), opts.ConnectTimeout)
+			defer cancel()
+			return cfg.dial(ctx, server)
+		})
+	}
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetAutoAckDisabled(cfg.manualAck)
+	clientOptions.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		cfg.onConnectionLost(err)
+	})
+	clientOptions.SetOnConnectHandler(func(_ mqtt.Client) {
+		cfg.onConnect()
+	})
+
+	c := clientV3{
+		servers:   len(clientOptions.Servers),
+		manualAck: cfg.manualAck,
+		certs:     cfg.certs,
+	}
+	clientOptions.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		c.serverURL.Store(broker)
+		c.session.Add(1)
+		return tlsCfg
+	})
+	if cfg.defaultHandler != nil {
+		clientOptions.SetDefaultPublishHandler(c.callback(cfg.defaultHandler))
+	}
+	c.client = mqtt.NewClient(clientOptions)
+	return &c
+}
+
+func (c *clientV3) Connect() error {
+	if c.servers == 0 {
+		return nil
+	}
+	tok := c.client.Connect()
+	tok.Wait()
+	return tok.Error()
+}
+
+func (c *clientV3) Publish(msg *message) error {
+	if msg.properties != nil {
+		return errRequiresV5("properties")
+	}
+	tok := c.client.Publish(msg.topic, msg.qos, msg.retained, msg.payload)
+	tok.Wait()
+	if pt, ok := tok.(*mqtt.PublishToken); ok {
+		msg.messageID = pt.MessageID()
+	}
+	return tok.Error()
+}
+
+func (c *clientV3) Subscribe(topic string, qos byte, handler messageHandler) error {
+	tok := c.client.Subscribe(topic, qos, c.callback(handler))
+	tok.Wait()
+	return tok.Error()
+}
+
+func (c *clientV3) callback(handler messageHandler) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		m := message{
+			messageID: msg.MessageID(),
+			topic:     msg.Topic(),
+			payload:   msg.Payload(),
+			qos:       msg.Qos(),
+			retained:  msg.Retained(),
+			duplicate: msg.Duplicate(),
+		}
+		if c.manualAck {
+			session := c.session.Load()
+			m.ack = func() {
+				// paho sends the ack on the current connection, waiting for one
+				// while disconnected: the broker redelivers the message anyway
+				if c.client.IsConnectionOpen() && c.session.Load() == session {
+					msg.Ack()
+				}
+			}
+		}
+		handler(&m)
+		if !c.manualAck {
+			msg.Ack()
+		}
+	}
+}
+
+func (c *clientV3) Unsubscribe(topics ...string) error {
+	tok := c.client.Unsubscribe(topics...)
+	tok.Wait()
+	return tok.Error()
+}
+
+func (c *clientV3) Disconnect() {
+	c.client.Disconnect(200)
+}
+
+func (c *clientV3) ClientID() string {
+	opts := c.client.OptionsReader()
+	return opts.ClientID()
+}
+
+func (c *clientV3) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *clientV3) ServerURL() string {
+	if u := c.serverURL.Load(); u != nil {
+		return u.Redacted()
+	}
+	return ""
+}
+
+func (c *clientV3) Certificate() *x509.Certificate {
+	return c.certs.leaf()
+}
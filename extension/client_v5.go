@@ -0,0 +1,487 @@
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	"github.com/gorilla/websocket"
+)
+
+// clientV5 is an MQTT 5 client backed by paho.golang autopaho.
+type clientV5 struct {
+	cfg autopaho.ClientConfig
+	cm  atomic.Pointer[autopaho.ConnectionManager]
+	// connMu orders Connect and Disconnect, which may run on different goroutines
+	connMu    sync.Mutex
+	closed    bool
+	clientID  string
+	connected atomic.Bool
+	serverURL atomic.Pointer[url.URL]
+	certs     *certLoader
+
+	// session options shared with the MQTT 3.1.1 client
+	orderMatters         bool
+	connectRetry         bool
+	connectRetryInterval time.Duration
+	maxReconnectInterval time.Duration
+	connectedOnce        atomic.Bool
+
+	handlers       map[string]messageHandler
+	defaultHandler messageHandler
+	mu             sync.RWMutex
+
+	// subscription identifiers are assigned per topic filter when the broker supports them
+	subIDs         map[string]int
+	subIDAvailable bool
+
+	// connectErr receives connection errors until the first connection is established
+	connectErr chan error
+}
+
+func newClientV5(cfg clientConfig) (*clientV5, error) {
+	opts := cfg.options
+	c := clientV5{
+		clientID:       opts.ClientID,
+		handlers:       make(map[string]messageHandler),
+		defaultHandler: cfg.defaultHandler,
+		certs:          cfg.certs,
+		subIDs:         make(map[string]int),
+		connectErr:     make(chan error, len(opts.Servers)),
+
+		orderMatters:         opts.Order,
+		connectRetry:         opts.ConnectRetry,
+		connectRetryInterval: opts.ConnectRetryInterval,
+		maxReconnectInterval: opts.MaxReconnectInterval,
+	}
+
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    opts.Servers,
+		TlsCfg:                        opts.TLSConfig,
+		KeepAlive:                     uint16(opts.KeepAlive),
+		CleanStartOnInitialConnection: opts.CleanSession,
+		SessionExpiryInterval:         cfg.sessionExpiry,
+		ConnectTimeout:                opts.ConnectTimeout,
+		ConnectUsername:               opts.Username,
+		ConnectPassword:               []byte(opts.Password),
+		ReconnectBackoff:              c.reconnectBackoff,
+		AttemptConnection:             attemptConnection(cfg.dial, opts.ConnectTimeout),
+		WebSocketCfg: &autopaho.WebSocketConfig{
+			Dialer: func(_ *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+				d := *websocket.DefaultDialer
+				d.TLSClientConfig = tlsCfg
+				d.Subprotocols = []string{"mqtt"}
+				if opts.WebsocketOptions != nil && opts.WebsocketOptions.Proxy != nil {
+					d.Proxy = opts.WebsocketOptions.Proxy
+				}
+				return &d
+			},
+			Header: func(*url.URL, *tls.Config) http.Header {
+				return opts.HTTPHeaders
+			},
+		},
+		ConnectPacketBuilder: func(cp *paho.Connect, u *url.URL) (*paho.Connect, error) {
+			c.serverURL.Store(u)
+			// the credentials may be read from files on every attempt
+			if opts.CredentialsProvider != nil {
+				username, password := opts.CredentialsProvider()
+				cp.Username, cp.UsernameFlag = username, username != ""
+				cp.Password, cp.PasswordFlag = []byte(password), password != ""
+			}
+			return cp, nil
+		},
+		OnConnectionUp: func(_ *autopaho.ConnectionManager, connack *paho.Connack) {
+			c.mu.Lock()
+			c.subIDAvailable = connack.Properties == nil || connack.Properties.SubIDAvailable
+			if connack.Properties != nil && connack.Properties.AssignedClientID != "" {
+				c.clientID = connack.Properties.AssignedClientID
+			}
+			c.mu.Unlock()
+			c.connected.Store(true)
+			c.connectedOnce.Store(true)
+			go cfg.onConnect()
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			return true
+		},
+		OnConnectError: func(err error) {
+			if cfg.onConnectError != nil {
+				cfg.onConnectError(err)
+			}
+			select {
+			case c.connectErr <- err:
+			default:
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   opts.ClientID,
+			PacketTimeout:              opts.WriteTimeout,
+			EnableManualAcknowledgment: cfg.manualAck,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				c.route,
+			},
+			OnClientError: func(err error) {
+				go cfg.onConnectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				go cfg.onConnectionLost(fmt.Errorf("disconnected by the server, reason code %d", d.ReasonCode))
+			},
+		},
+	}
+
+	if w := cfg.will; w != nil {
+		c.cfg.WillMessage = &paho.WillMessage{
+			Topic:   w.topic,
+			Payload: w.payload,
+			QoS:     w.qos,
+			Retain:  w.retained,
+		}
+		c.cfg.WillProperties = &paho.WillProperties{
+			WillDelayInterval: w.delay,
+		}
+		for _, up := range w.properties {
+			c.cfg.WillProperties.User.Add(up.key, up.value)
+		}
+	}
+
+	if cfg.storage != "" {
+		clientStore, err := file.New(cfg.storage, "client", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage: %w", err)
+		}
+		serverStore, err := file.New(cfg.storage, "server", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage: %w", err)
+		}
+		c.cfg.Session = &packetIDSession{SessionManager: state.New(clientStore, serverStore)}
+	} else {
+		c.cfg.Session = &packetIDSession{SessionManager: state.NewInMemory()}
+	}
+
+	return &c, nil
+}
+
+// Connect blocks until the first connection is established or every server refused it.
+// Once connected, autopaho keeps reconnecting in the background.
+func (c *clientV5) Connect() error {
+	if len(c.cfg.ServerUrls) == 0 {
+		return nil
+	}
+	c.connMu.Lock()
+	if c.closed {
+		c.connMu.Unlock()
+		return errNotConnected
+	}
+	cm, err := autopaho.NewConnection(context.Background(), c.cfg)
+	if err != nil {
+		c.connMu.Unlock()
+		return err
+	}
+	c.cm.Store(cm)
+	c.connMu.Unlock()
+
+	connected := make(chan error, 1)
+	go func() {
+		connected <- cm.AwaitConnection(context.Background())
+	}()
+
+	var errs []string
+	for {
+		select {
+		case err := <-connected:
+			return err
+		case err := <-c.connectErr:
+			errs = append(errs, err.Error())
+			// with connect_retry wait until the broker is reachable
+			if len(errs) < len(c.cfg.ServerUrls) || c.connectRetry {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			cm.Disconnect(ctx)
+			c.cm.Store(nil)
+			return fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+	}
+}
+
+func (c *clientV5) Publish(msg *message) error {
+	cm := c.cm.Load()
+	if cm == nil {
+		return errNotConnected
+	}
+	p := paho.Publish{
+		Topic:   msg.topic,
+		QoS:     msg.qos,
+		Retain:  msg.retained,
+		Payload: msg.payload,
+	}
+	if props := msg.properties; props != nil {
+		p.Properties = &paho.PublishProperties{
+			ContentType:     props.contentType,
+			ResponseTopic:   props.responseTopic,
+			CorrelationData: props.correlationData,
+			MessageExpiry:   props.messageExpiry,
+			PayloadFormat:   props.payloadFormat,
+		}
+		for _, up := range props.user {
+			p.Properties.User.Add(up.key, up.value)
+		}
+	}
+	ctx := context.WithValue(context.Background(), packetIDKey{}, &msg.messageID)
+	_, err := cm.Publish(ctx, &p)
+	return err
+}
+
+func (c *clientV5) Subscribe(topic string, qos byte, handler messageHandler) error {
+	cm := c.cm.Load()
+	if cm == nil {
+		return errNotConnected
+	}
+	sub := paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	}
+	c.mu.Lock()
+	c.handlers[topic] = handler
+	if c.subIDAvailable {
+		id, ok := c.subIDs[topic]
+		if !ok {
+			id = len(c.subIDs) + 1
+			c.subIDs[topic] = id
+		}
+		sub.Properties = &paho.SubscribeProperties{SubscriptionIdentifier: &id}
+	}
+	c.mu.Unlock()
+
+	suback, err := cm.Subscribe(context.Background(), &sub)
+	if err == nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		err = fmt.Errorf("subscription refused, reason code %d", suback.Reasons[0])
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.handlers, topic)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *clientV5) Unsubscribe(topics ...string) error {
+	cm := c.cm.Load()
+	if cm == nil {
+		return errNotConnected
+	}
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.handlers, topic)
+	}
+	c.mu.Unlock()
+
+	_, err := cm.Unsubscribe(context.Background(), &paho.Unsubscribe{
+		Topics: topics,
+	})
+	return err
+}
+
+func (c *clientV5) Disconnect() {
+	c.connMu.Lock()
+	c.closed = true
+	c.connMu.Unlock()
+	cm := c.cm.Load()
+	if cm == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cm.Disconnect(ctx)
+}
+
+func (c *clientV5) ClientID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientID
+}
+
+func (c *clientV5) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *clientV5) ServerURL() string {
+	if u := c.serverURL.Load(); u != nil {
+		return u.Redacted()
+	}
+	return ""
+}
+
+func (c *clientV5) Certificate() *x509.Certificate {
+	return c.certs.leaf()
+}
+
+type packetIDKey struct{}
+
+// packetIDSession reports the packet identifier assigned to a QoS 1 or 2 PUBLISH
+// back to the caller, through a *uint16 stored in the context under packetIDKey.
+type packetIDSession struct {
+	session.SessionManager
+}
+
+func (s *packetIDSession) AddToSession(ctx context.Context, packet session.Packet, resp chan<- packets.ControlPacket) error {
+	err := s.SessionManager.AddToSession(ctx, packet, resp)
+	if err != nil {
+		return err
+	}
+	if pb, ok := packet.(*packets.Publish); ok {
+		if id, ok := ctx.Value(packetIDKey{}).(*uint16); ok {
+			*id = pb.PacketID
+		}
+	}
+	return nil
+}
+
+// attemptConnection opens the connections with the registered dialer of the
+// servers, nil to use the autopaho transports.
+func attemptConnection(dial Dialer, timeout time.Duration) func(context.Context, autopaho.ClientConfig, *url.URL) (net.Conn, error) {
+	if dial == nil {
+		return nil
+	}
+	return func(ctx context.Context, _ autopaho.ClientConfig, server *url.URL) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := dial(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+		// autopaho requires thread safe writes
+		return packets.NewThreadSafeConn(conn), nil
+	}
+}
+
+// reconnectBackoff mirrors paho.mqtt.golang: a fixed connect_retry_interval until the
+// first connection, then an exponential delay from 1 second up to max_reconnect_interval.
+func (c *clientV5) reconnectBackoff(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+	if !c.connectedOnce.Load() {
+		return c.connectRetryInterval
+	}
+	delay := time.Second
+	for i := 1; i < attempt && delay < c.maxReconnectInterval; i++ {
+		delay *= 2
+	}
+	return min(delay, c.maxReconnectInterval)
+}
+
+// route delivers an incoming PUBLISH to the subscriptions it was sent for.
+func (c *clientV5) route(pr paho.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := message{
+		messageID: p.PacketID,
+		topic:     p.Topic,
+		payload:   p.Payload,
+		qos:       p.QoS,
+		retained:  p.Retain,
+		duplicate: p.Duplicate(),
+	}
+	if c.cfg.EnableManualAcknowledgment {
+		msg.ack = func() {
+			// fails when the connection was lost, the broker redelivers the message anyway
+			_ = pr.Client.Ack(p)
+		}
+	}
+	if props := p.Properties; props != nil {
+		msg.properties = &messageProperties{
+			contentType:            props.ContentType,
+			responseTopic:          props.ResponseTopic,
+			correlationData:        props.CorrelationData,
+			messageExpiry:          props.MessageExpiry,
+			payloadFormat:          props.PayloadFormat,
+			subscriptionIdentifier: props.SubscriptionIdentifier,
+		}
+		for _, up := range props.User {
+			msg.properties.user = append(msg.properties.user, userProperty{key: up.Key, value: up.Value})
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var handled bool
+	for _, handler := range c.handlersFor(p) {
+		if c.orderMatters {
+			handler(&msg)
+		} else {
+			go handler(&msg)
+		}
+		handled = true
+	}
+	if !handled && c.defaultHandler != nil {
+		c.defaultHandler(&msg)
+		handled = true
+	}
+	return handled, nil
+}
+
+// handlersFor returns the handlers of the subscriptions the PUBLISH was sent for:
+// the one of its subscription identifier, or, when the broker doesn't send one,
+// the ones of every filter matching the topic. The caller must hold mu.
+func (c *clientV5) handlersFor(p *paho.Publish) []messageHandler {
+	if p.Properties != nil && p.Properties.SubscriptionIdentifier != nil {
+		id := *p.Properties.SubscriptionIdentifier
+		for filter, subID := range c.subIDs {
+			if subID != id {
+				continue
+			}
+			if handler, ok := c.handlers[filter]; ok {
+				return []messageHandler{handler}
+			}
+			// unsubscribed since the broker sent it
+			return nil
+		}
+	}
+	var handlers []messageHandler
+	for filter, handler := range c.handlers {
+		if topicMatches(filter, p.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+// topicMatches reports whether the topic matches the subscription filter,
+// including the + and # wildcards and $share/<group>/ shared subscriptions.
+func topicMatches(filter, topic string) bool {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if _, f, ok := strings.Cut(rest, "/"); ok {
+			filter = f
+		}
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
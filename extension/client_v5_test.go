@@ -0,0 +1,33 @@
+package extension
+
+import "testing"
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/b", "a/b", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"$share/group/a/+", "a/b", true},
+		{"$share/group/a/+", "a/b/c", false},
+		{"$share/group/#", "a/b", true},
+		{"$share/group/a/b", "$share/group/a/b", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
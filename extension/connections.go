@@ -0,0 +1,185 @@
+package extension
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/walterwanderley/sqlite"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// ConnectionsModule is the eponymous mqtt_connections virtual table, listing
+// the MQTT client of every publisher and subscriber virtual table in the process.
+type ConnectionsModule struct {
+}
+
+func (m *ConnectionsModule) Connect(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	err := declare(`CREATE TABLE x(
+		virtual_table TEXT,
+		schema TEXT,
+		module TEXT,
+		client_id TEXT,
+		broker TEXT,
+		connected INTEGER,
+		connected_since DATETIME,
+		reconnects INTEGER,
+		last_error TEXT,
+		last_error_time DATETIME,
+		cert_expires_at DATETIME
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectionsVirtualTable{}, nil
+}
+
+type ConnectionsVirtualTable struct {
+}
+
+func (vt *ConnectionsVirtualTable) BestIndex(in *sqlite.IndexInfoInput) (*sqlite.IndexInfoOutput, error) {
+	return &sqlite.IndexInfoOutput{EstimatedCost: 1000}, nil
+}
+
+func (vt *ConnectionsVirtualTable) Open() (sqlite.VirtualCursor, error) {
+	return newConnectionsCursor(liveConnections()), nil
+}
+
+func (vt *ConnectionsVirtualTable) Disconnect() error {
+	return nil
+}
+
+func (vt *ConnectionsVirtualTable) Destroy() error {
+	return nil
+}
+
+type connectionRow struct {
+	virtualTable string
+	schema       string
+	module       string
+	client       client
+	status       connSnapshot
+}
+
+// liveConnections takes a snapshot of the registered virtual tables, one row for
+// each of them, even when tables on different database connections share a name.
+func liveConnections() []connectionRow {
+	var list []connectionRow
+	publishers.each(func(vt *PublisherVirtualTable, id tableID) {
+		list = append(list, connectionRow{
+			virtualTable: id.name,
+			schema:       id.schema,
+			module:       config.DefaultPublisherVTabName,
+			client:       vt.client,
+			status:       vt.status.snapshot(),
+		})
+	})
+	subscribers.each(func(vt *SubscriberVirtualTable, id tableID) {
+		list = append(list, connectionRow{
+			virtualTable: id.name,
+			schema:       id.schema,
+			module:       config.DefaultSubscriberVTabName,
+			client:       vt.client,
+			status:       vt.status.snapshot(),
+		})
+	})
+	return list
+}
+
+type connectionsCursor struct {
+	data    []connectionRow
+	current connectionRow // current row that the cursor points to
+	rowid   int64         // current rowid .. negative for EOF
+}
+
+func newConnectionsCursor(data []connectionRow) *connectionsCursor {
+	slices.SortFunc(data, func(a, b connectionRow) int {
+		return cmp.Or(cmp.Compare(a.module, b.module), cmp.Compare(a.virtualTable, b.virtualTable), cmp.Compare(a.schema, b.schema))
+	})
+	return &connectionsCursor{
+		data: data,
+	}
+}
+
+func (c *connectionsCursor) Next() error {
+	// EOF
+	if c.rowid < 0 || int(c.rowid) >= len(c.data) {
+		c.rowid = -1
+		return sqlite.SQLITE_OK
+	}
+	// slices are zero based
+	c.current = c.data[c.rowid]
+	c.rowid += 1
+
+	return sqlite.SQLITE_OK
+}
+
+func (c *connectionsCursor) Column(ctx *sqlite.VirtualTableContext, i int) error {
+	switch i {
+	case 0:
+		ctx.ResultText(c.current.virtualTable)
+	case 1:
+		ctx.ResultText(c.current.schema)
+	case 2:
+		ctx.ResultText(c.current.module)
+	case 3:
+		ctx.ResultText(c.current.client.ClientID())
+	case 4:
+		if broker := c.current.client.ServerURL(); broker != "" {
+			ctx.ResultText(broker)
+		} else {
+			ctx.ResultNull()
+		}
+	case 5:
+		if c.current.status.connected {
+			ctx.ResultInt(1)
+		} else {
+			ctx.ResultInt(0)
+		}
+	case 6:
+		resultTime(ctx, c.current.status.connectedSince)
+	case 7:
+		ctx.ResultInt(c.current.status.reconnects)
+	case 8:
+		if err := c.current.status.lastErr; err != nil {
+			ctx.ResultText(err.Error())
+		} else {
+			ctx.ResultNull()
+		}
+	case 9:
+		resultTime(ctx, c.current.status.lastErrTime)
+	case 10:
+		if cert := c.current.client.Certificate(); cert != nil {
+			resultTime(ctx, cert.NotAfter)
+		} else {
+			ctx.ResultNull()
+		}
+	}
+	return nil
+}
+
+func resultTime(ctx *sqlite.VirtualTableContext, t time.Time) {
+	if t.IsZero() {
+		ctx.ResultNull()
+		return
+	}
+	ctx.ResultText(t.Format(time.RFC3339Nano))
+}
+
+func (c *connectionsCursor) Filter(int, string, ...sqlite.Value) error {
+	c.rowid = 0
+	return c.Next()
+}
+
+func (c *connectionsCursor) Rowid() (int64, error) {
+	return c.rowid, nil
+}
+
+func (c *connectionsCursor) Eof() bool {
+	return c.rowid < 0
+}
+
+func (c *connectionsCursor) Close() error {
+	return nil
+}
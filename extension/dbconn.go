@@ -0,0 +1,151 @@
+package extension
+
+// #include <stdlib.h>
+// #include "../sqlite3ext.h"
+//
+// // set by the entry point of the extension
+// extern const sqlite3_api_routines *sqlite3_api;
+//
+// static int mqtt_open(const char *filename, sqlite3 **db, char **errmsg) {
+// 	int rc = sqlite3_api->open_v2(filename, db, SQLITE_OPEN_READWRITE | SQLITE_OPEN_URI, 0);
+// 	if (rc != SQLITE_OK) {
+// 		*errmsg = sqlite3_api->mprintf("%s", *db ? sqlite3_api->errmsg(*db) : sqlite3_api->errstr(rc));
+// 		sqlite3_api->close_v2(*db);
+// 		*db = 0;
+// 	}
+// 	return rc;
+// }
+//
+// static int mqtt_close(sqlite3 *db) {
+// 	return sqlite3_api->close_v2(db);
+// }
+//
+// static void mqtt_free(void *p) {
+// 	sqlite3_api->free(p);
+// }
+//
+// static int mqtt_mutex_try(sqlite3 *db) {
+// 	return sqlite3_api->mutex_try(sqlite3_api->db_mutex(db));
+// }
+//
+// static void mqtt_mutex_leave(sqlite3 *db) {
+// 	sqlite3_api->mutex_leave(sqlite3_api->db_mutex(db));
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/walterwanderley/sqlite"
+)
+
+// dbBusyTimeout is how long, in milliseconds, a background connection waits
+// for the locks held by the application.
+const dbBusyTimeout = 5000
+
+// dbConn is a connection of its own to the database file of the application,
+// used by the background tasks so that they never run statements, or start
+// transactions, on the connection of the application.
+type dbConn struct {
+	*sqlite.Conn
+	db *C.sqlite3
+}
+
+// openDBConn opens a connection to the file of the schema of the application
+// connection. It fails for in-memory and temporary databases, which can't be
+// shared between connections.
+func openDBConn(conn *sqlite.Conn, schema string) (*dbConn, error) {
+	file, err := databaseFile(conn, schema)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return nil, fmt.Errorf("the %q database is not stored in a file", schema)
+	}
+
+	cfile := C.CString(file)
+	defer C.free(unsafe.Pointer(cfile))
+	var (
+		db     *C.sqlite3
+		errmsg *C.char
+	)
+	if rc := C.mqtt_open(cfile, &db, &errmsg); rc != C.SQLITE_OK {
+		defer C.mqtt_free(unsafe.Pointer(errmsg))
+		return nil, fmt.Errorf("opening %q: %s", file, C.GoString(errmsg))
+	}
+
+	c := dbConn{db: db}
+	_, _ = sqlite.RegisterWith(sqlite.UnderlyingConnection(unsafe.Pointer(db)), func(api *sqlite.ExtensionApi) (sqlite.ErrorCode, error) {
+		c.Conn = api.Connection()
+		return sqlite.SQLITE_OK, nil
+	})
+	if err := c.Exec(fmt.Sprintf("PRAGMA busy_timeout = %d", dbBusyTimeout), nil); err != nil {
+		c.close()
+		return nil, fmt.Errorf("opening %q: %w", file, err)
+	}
+	return &c, nil
+}
+
+func (c *dbConn) close() error {
+	if rc := C.mqtt_close(c.db); rc != C.SQLITE_OK {
+		return sqlite.ErrorCode(rc)
+	}
+	return nil
+}
+
+// databaseFile returns the file of a schema of the connection, empty for
+// in-memory and temporary databases.
+func databaseFile(conn *sqlite.Conn, schema string) (string, error) {
+	var file string
+	err := conn.Exec("SELECT file FROM pragma_database_list WHERE name = ?", func(stmt *sqlite.Stmt) error {
+		file = stmt.ColumnText(0)
+		return nil
+	}, schema)
+	if err != nil {
+		return "", fmt.Errorf("reading the file of the %q database: %w", schema, err)
+	}
+	return file, nil
+}
+
+// sqliteHandle returns the database handle of a *sqlite.Conn or a
+// *sqlite.ExtensionApi, which keep it unexported.
+func sqliteHandle(v any) (*C.sqlite3, error) {
+	db := reflect.ValueOf(v).Elem().FieldByName("db")
+	if !db.IsValid() || db.Kind() != reflect.Pointer {
+		return nil, errors.New("unsupported version of github.com/walterwanderley/sqlite")
+	}
+	return (*C.sqlite3)(db.UnsafePointer()), nil
+}
+
+// connLock locks the connection of the application from another goroutine,
+// through the mutex SQLite holds while running its statements.
+type connLock struct {
+	db *C.sqlite3
+}
+
+func newConnLock(conn *sqlite.Conn) (connLock, error) {
+	db, err := sqliteHandle(conn)
+	return connLock{db: db}, err
+}
+
+// tryLock takes the lock without waiting for the statement running on the
+// connection, reporting whether it succeeded. The lock is recursive.
+func (l connLock) tryLock() bool {
+	return C.mqtt_mutex_try(l.db) == C.SQLITE_OK
+}
+
+func (l connLock) unlock() {
+	C.mqtt_mutex_leave(l.db)
+}
+
+// splitTableName returns the schema, main by default, and the name of a table.
+func splitTableName(table string) (string, string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+	return "main", table
+}
@@ -0,0 +1,76 @@
+package extension
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Dialer opens the network connection to a server of the broker.
+type Dialer func(ctx context.Context, server *url.URL) (net.Conn, error)
+
+var (
+	dialers = map[string]Dialer{
+		"unix": dialUnix,
+	}
+	dialersMu sync.RWMutex
+)
+
+// RegisterDialer registers the dialer of the servers with the URL scheme, like
+// pipe://broker for an in-process broker. It replaces the dialer registered with
+// the same scheme, or the transport of the MQTT client, like tcp. The virtual
+// tables created afterwards use the dialer.
+func RegisterDialer(scheme string, dial Dialer) {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	dialers[strings.ToLower(scheme)] = dial
+}
+
+func lookupDialer(scheme string) (Dialer, bool) {
+	dialersMu.RLock()
+	defer dialersMu.RUnlock()
+	dial, ok := dialers[strings.ToLower(scheme)]
+	return dial, ok
+}
+
+// dialUnix connects to unix:///run/mosquitto.sock, or unix://mosquitto.sock
+// relative to the working directory.
+func dialUnix(ctx context.Context, server *url.URL) (net.Conn, error) {
+	path := server.Path
+	if server.Host != "" {
+		path = server.Host + path
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
+
+// serversDialer returns the dialer of the servers, nil when they all use the
+// transports of the MQTT client. A server with a registered dialer can't be
+// mixed with the other ones, as the dialer replaces the client transports.
+func serversDialer(servers []*url.URL) (Dialer, error) {
+	var custom, builtin []string
+	for _, u := range servers {
+		if _, ok := lookupDialer(u.Scheme); ok {
+			custom = append(custom, u.Redacted())
+		} else {
+			builtin = append(builtin, u.Redacted())
+		}
+	}
+	if len(custom) == 0 {
+		return nil, nil
+	}
+	if len(builtin) > 0 {
+		return nil, fmt.Errorf("servers %s can't be mixed with %s", strings.Join(custom, ", "), strings.Join(builtin, ", "))
+	}
+	dial := func(ctx context.Context, server *url.URL) (net.Conn, error) {
+		dial, ok := lookupDialer(server.Scheme)
+		if !ok {
+			return nil, fmt.Errorf("no dialer registered for %q", server.Scheme)
+		}
+		return dial(ctx, server)
+	}
+	return dial, nil
+}
@@ -0,0 +1,77 @@
+package extension_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/litesql/mqtt/extension/loader"
+)
+
+func TestDialers(t *testing.T) {
+	tests := []struct {
+		name string
+		// start starts the broker, returning the server of the virtual table
+		start func(t *testing.T) (*broker, string)
+	}{
+		{
+			name: "unix socket",
+			start: func(t *testing.T) (*broker, string) {
+				sock := filepath.Join(t.TempDir(), "mqtt.sock")
+				return startBroker(t, listeners.NewUnixSock(listeners.Config{ID: "unix", Address: sock})), "unix://" + sock
+			},
+		},
+		{
+			name: "relative unix socket",
+			start: func(t *testing.T) (*broker, string) {
+				t.Chdir(t.TempDir())
+				return startBroker(t, listeners.NewUnixSock(listeners.Config{ID: "unix", Address: "mqtt.sock"})), "unix://mqtt.sock"
+			},
+		},
+		{
+			name: "registered dialer",
+			start: func(t *testing.T) (*broker, string) {
+				s := startBroker(t)
+				loader.RegisterDialer("pipe", func(ctx context.Context, server *url.URL) (net.Conn, error) {
+					client, conn := net.Pipe()
+					go s.EstablishConnection("pipe", conn)
+					return client, nil
+				})
+				return s, "pipe://broker"
+			},
+		},
+	}
+	for _, version := range []string{"4", "5"} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s mqtt%s", tt.name, version), func(t *testing.T) {
+				s, server := tt.start(t)
+				r := record(t, s, "dial/#")
+				conn := openDB(t, "")
+
+				mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='%s', protocol_version=%s)", server, version))
+				mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('dial/1', 'hello')")
+				r.waitUntil(t, "hello")
+				if n := queryInt(t, conn, "SELECT count(*) FROM mqtt_connections WHERE broker = ?", server); n != 1 {
+					t.Errorf("mqtt_connections lists %d clients connected to %s, want 1", n, server)
+				}
+			})
+		}
+	}
+}
+
+func TestDialersMixed(t *testing.T) {
+	loader.RegisterDialer("pipe", func(ctx context.Context, server *url.URL) (net.Conn, error) {
+		return nil, fmt.Errorf("not dialed")
+	})
+	conn := openDB(t, "")
+	_, err := conn.ExecContext(context.Background(), "CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='pipe://broker,tcp://127.0.0.1:1883')")
+	if want := "can't be mixed"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
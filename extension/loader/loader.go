@@ -1,6 +1,6 @@
 package loader
 
-import _ "github.com/litesql/mqtt/extension"
+import "github.com/litesql/mqtt/extension"
 
 // #cgo CFLAGS: -DSQLITE_CORE
 //
@@ -12,3 +12,21 @@ import "C"
 func init() {
 	C.sqlite3_auto_extension((*[0]byte)(C.sqlite3_extension_init))
 }
+
+// Dialer opens the network connection to a server of the broker.
+type Dialer = extension.Dialer
+
+// RegisterDialer registers the dialer of the servers with the URL scheme, so
+// applications embedding the extension can connect the virtual tables to a broker
+// through any net.Conn, like net.Pipe to an in-process broker:
+//
+//	loader.RegisterDialer("pipe", func(ctx context.Context, server *url.URL) (net.Conn, error) {
+//		client, srv := net.Pipe()
+//		go broker.EstablishConnection("pipe", srv)
+//		return client, nil
+//	})
+//
+// and then CREATE VIRTUAL TABLE pub USING mqtt_pub(servers='pipe://broker').
+func RegisterDialer(scheme string, dial Dialer) {
+	extension.RegisterDialer(scheme, dial)
+}
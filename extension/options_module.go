@@ -0,0 +1,135 @@
+package extension
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/walterwanderley/sqlite"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// OptionsModule is the eponymous mqtt_options table-valued function, listing the
+// options of the registry. mqtt_options('mqtt_sub') lists the ones of a module.
+type OptionsModule struct {
+}
+
+func (m *OptionsModule) Connect(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	err := declare(`CREATE TABLE x(
+		name TEXT,
+		type TEXT,
+		default_value TEXT,
+		modules TEXT,
+		description TEXT,
+		module HIDDEN
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &OptionsVirtualTable{}, nil
+}
+
+// moduleColumn is the hidden column filled by the argument of mqtt_options.
+const moduleColumn = 5
+
+type OptionsVirtualTable struct {
+}
+
+func (vt *OptionsVirtualTable) BestIndex(in *sqlite.IndexInfoInput) (*sqlite.IndexInfoOutput, error) {
+	out := sqlite.IndexInfoOutput{
+		ConstraintUsage: make([]*sqlite.ConstraintUsage, len(in.Constraints)),
+		EstimatedCost:   100,
+	}
+	for i, c := range in.Constraints {
+		if c.Usable && c.ColumnIndex == moduleColumn && c.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			out.ConstraintUsage[i] = &sqlite.ConstraintUsage{ArgvIndex: 1, Omit: true}
+			out.IndexNumber = 1
+			out.EstimatedCost = 10
+			break
+		}
+	}
+	return &out, nil
+}
+
+func (vt *OptionsVirtualTable) Open() (sqlite.VirtualCursor, error) {
+	return &optionsCursor{}, nil
+}
+
+func (vt *OptionsVirtualTable) Disconnect() error {
+	return nil
+}
+
+func (vt *OptionsVirtualTable) Destroy() error {
+	return nil
+}
+
+type optionsCursor struct {
+	data    []config.Option
+	module  string
+	current config.Option // current row that the cursor points to
+	rowid   int64         // current rowid .. negative for EOF
+}
+
+func (c *optionsCursor) Next() error {
+	// EOF
+	if c.rowid < 0 || int(c.rowid) >= len(c.data) {
+		c.rowid = -1
+		return sqlite.SQLITE_OK
+	}
+	// slices are zero based
+	c.current = c.data[c.rowid]
+	c.rowid += 1
+
+	return sqlite.SQLITE_OK
+}
+
+func (c *optionsCursor) Column(ctx *sqlite.VirtualTableContext, i int) error {
+	switch i {
+	case 0:
+		ctx.ResultText(c.current.Name)
+	case 1:
+		ctx.ResultText(c.current.Type)
+	case 2:
+		if c.current.Default != "" {
+			ctx.ResultText(c.current.Default)
+		} else {
+			ctx.ResultNull()
+		}
+	case 3:
+		ctx.ResultText(strings.Join(c.current.Modules, ","))
+	case 4:
+		ctx.ResultText(c.current.Description)
+	case moduleColumn:
+		if c.module != "" {
+			ctx.ResultText(c.module)
+		} else {
+			ctx.ResultNull()
+		}
+	}
+	return nil
+}
+
+func (c *optionsCursor) Filter(idxNum int, _ string, values ...sqlite.Value) error {
+	c.data = config.Options
+	c.module = ""
+	if idxNum == 1 && len(values) > 0 {
+		c.module = values[0].Text()
+		c.data = slices.DeleteFunc(slices.Clone(config.Options), func(o config.Option) bool {
+			return !o.SupportedBy(c.module)
+		})
+	}
+	c.rowid = 0
+	return c.Next()
+}
+
+func (c *optionsCursor) Rowid() (int64, error) {
+	return c.rowid, nil
+}
+
+func (c *optionsCursor) Eof() bool {
+	return c.rowid < 0
+}
+
+func (c *optionsCursor) Close() error {
+	return nil
+}
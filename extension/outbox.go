@@ -0,0 +1,294 @@
+package extension
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/walterwanderley/sqlite"
+)
+
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+
+	outboxRetryInterval = 10 * time.Second
+)
+
+// outbox stores the published messages in a table and delivers them
+// in order from a background goroutine while the broker is reachable.
+//
+// The messages are stored through the connection of the application, as part
+// of its transactions, and read and updated through a connection of their own,
+// where only the committed ones are visible.
+type outbox struct {
+	conn  *sqlite.Conn
+	db    *dbConn
+	table string
+	// name is the table without the schema, as seen by db
+	name string
+	// maxAttempts is the number of delivery attempts of a message before it
+	// is marked as failed, 0 to retry forever
+	maxAttempts int
+	// retention is how long the delivered messages are kept
+	retention time.Duration
+	client    client
+	logger    *slog.Logger
+
+	signal chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newOutbox(conn *sqlite.Conn, table string, maxAttempts int, retention time.Duration) (*outbox, error) {
+	err := conn.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		topic TEXT NOT NULL,
+		payload BLOB,
+		qos INTEGER,
+		retained INTEGER,
+		properties TEXT,
+		content_type TEXT,
+		response_topic TEXT,
+		correlation_data BLOB,
+		message_expiry INTEGER,
+		payload_format INTEGER,
+		status TEXT NOT NULL DEFAULT '%s',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at DATETIME,
+		updated_at DATETIME
+	)`, table, outboxPending), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating %q table: %w", table, err)
+	}
+	schema, name := splitTableName(table)
+	db, err := openDBConn(conn, schema)
+	if err != nil {
+		return nil, fmt.Errorf("outbox table %q: %w", table, err)
+	}
+	return &outbox{
+		conn:        conn,
+		db:          db,
+		table:       table,
+		name:        name,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// start launches the flusher delivering queued messages using the client.
+func (o *outbox) start(client client, logger *slog.Logger) {
+	o.client = client
+	o.logger = logger
+	o.wg.Add(1)
+	go o.run()
+	o.notify()
+}
+
+func (o *outbox) close() error {
+	close(o.done)
+	o.wg.Wait()
+	return o.db.close()
+}
+
+// notify wakes up the flusher.
+func (o *outbox) notify() {
+	select {
+	case o.signal <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue stores the message in the table as part of the current transaction.
+func (o *outbox) enqueue(msg *message) error {
+	var (
+		properties      any
+		contentType     any
+		responseTopic   any
+		correlationData any
+		messageExpiry   any
+		payloadFormat   any
+	)
+	if props := msg.properties; props != nil {
+		if len(props.user) > 0 {
+			user, err := formatUserProperties(props.user)
+			if err != nil {
+				return err
+			}
+			properties = user
+		}
+		if props.contentType != "" {
+			contentType = props.contentType
+		}
+		if props.responseTopic != "" {
+			responseTopic = props.responseTopic
+		}
+		if props.correlationData != nil {
+			correlationData = props.correlationData
+		}
+		if props.messageExpiry != nil {
+			messageExpiry = *props.messageExpiry
+		}
+		if props.payloadFormat != nil {
+			payloadFormat = *props.payloadFormat
+		}
+	}
+	return o.conn.Exec(fmt.Sprintf(`INSERT INTO %s(topic, payload, qos, retained, properties, content_type, response_topic, correlation_data, message_expiry, payload_format, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, o.table), nil,
+		msg.topic, msg.payload, msg.qos, msg.retained, properties, contentType, responseTopic, correlationData, messageExpiry, payloadFormat, time.Now().Format(time.RFC3339Nano))
+}
+
+func (o *outbox) run() {
+	defer o.wg.Done()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.signal:
+			err := o.flush()
+			if err == nil {
+				err = o.prune()
+			}
+			if err != nil {
+				o.logger.Error("outbox delivery", "table", o.table, "error", err)
+				time.AfterFunc(outboxRetryInterval, o.notify)
+			}
+		}
+	}
+}
+
+// flush delivers the queued messages in order, stopping on the first failure
+// so that the next attempt starts again from the same message, unless it used
+// up its attempts.
+func (o *outbox) flush() error {
+	for {
+		select {
+		case <-o.done:
+			return nil
+		default:
+		}
+		if !o.client.IsConnected() {
+			return nil
+		}
+		id, attempts, msg, err := o.next()
+		if err != nil || msg == nil {
+			return err
+		}
+		deliveryErr := o.client.Publish(msg)
+		switch {
+		case deliveryErr == nil:
+			err = o.mark(id, outboxDelivered, nil)
+		case o.maxAttempts == 0 || attempts+1 < o.maxAttempts:
+			if err := o.mark(id, outboxPending, deliveryErr); err != nil {
+				return err
+			}
+			return deliveryErr
+		default:
+			o.logger.Error("outbox message failed", "table", o.table, "id", id, "attempts", attempts+1, "error", deliveryErr)
+			err = o.mark(id, outboxFailed, deliveryErr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// next reads the oldest committed message pending delivery, with the number of
+// attempts made, or nil when the queue is empty.
+func (o *outbox) next() (int64, int, *message, error) {
+	var (
+		id       int64
+		attempts int
+		msg      *message
+	)
+	err := o.db.Exec(fmt.Sprintf(`SELECT id, topic, payload, qos, retained, properties, content_type, response_topic, correlation_data, message_expiry, payload_format, attempts
+		FROM %s WHERE status = '%s' ORDER BY id LIMIT 1`, o.name, outboxPending), func(stmt *sqlite.Stmt) error {
+		id = stmt.ColumnInt64(0)
+		attempts = stmt.ColumnInt(11)
+		msg = &message{
+			topic:    stmt.ColumnText(1),
+			payload:  columnBlob(stmt, 2),
+			qos:      byte(stmt.ColumnInt(3)),
+			retained: stmt.ColumnInt(4) > 0,
+		}
+		var (
+			props messageProperties
+			set   bool
+		)
+		if stmt.ColumnType(5) != sqlite.SQLITE_NULL {
+			user, err := parseUserProperties(stmt.ColumnText(5))
+			if err != nil {
+				return err
+			}
+			props.user, set = user, true
+		}
+		if stmt.ColumnType(6) != sqlite.SQLITE_NULL {
+			props.contentType, set = stmt.ColumnText(6), true
+		}
+		if stmt.ColumnType(7) != sqlite.SQLITE_NULL {
+			props.responseTopic, set = stmt.ColumnText(7), true
+		}
+		if stmt.ColumnType(8) != sqlite.SQLITE_NULL {
+			props.correlationData, set = columnBlob(stmt, 8), true
+		}
+		if stmt.ColumnType(9) != sqlite.SQLITE_NULL {
+			messageExpiry := uint32(stmt.ColumnInt64(9))
+			props.messageExpiry, set = &messageExpiry, true
+		}
+		if stmt.ColumnType(10) != sqlite.SQLITE_NULL {
+			payloadFormat := byte(stmt.ColumnInt(10))
+			props.payloadFormat, set = &payloadFormat, true
+		}
+		if set {
+			msg.properties = &props
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("reading %q table: %w", o.table, err)
+	}
+	return id, attempts, msg, nil
+}
+
+// mark records the outcome of a delivery attempt.
+func (o *outbox) mark(id int64, status string, deliveryErr error) error {
+	var errText any
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	err := o.db.Exec(fmt.Sprintf(`UPDATE %s SET status = ?, attempts = attempts + 1, error = ?, updated_at = ? WHERE id = ?`, o.name), nil,
+		status, errText, time.Now().Format(time.RFC3339Nano), id)
+	if err != nil {
+		return fmt.Errorf("updating %q table: %w", o.table, err)
+	}
+	return nil
+}
+
+// prune deletes the messages delivered before the retention period.
+func (o *outbox) prune() error {
+	const expired = `FROM %s WHERE status = '%s' AND julianday(updated_at) <= julianday(?)`
+	cutoff := time.Now().Add(-o.retention).Format(time.RFC3339Nano)
+	// only wait for the write lock when there is something to delete
+	var found bool
+	err := o.db.Exec(fmt.Sprintf("SELECT 1 "+expired+" LIMIT 1", o.name, outboxDelivered), func(stmt *sqlite.Stmt) error {
+		found = true
+		return nil
+	}, cutoff)
+	if err == nil && found {
+		err = o.db.Exec(fmt.Sprintf("DELETE "+expired, o.name, outboxDelivered), nil, cutoff)
+	}
+	if err != nil {
+		return fmt.Errorf("pruning %q table: %w", o.table, err)
+	}
+	return nil
+}
+
+func columnBlob(stmt *sqlite.Stmt, col int) []byte {
+	b := make([]byte, stmt.ColumnLen(col))
+	stmt.ColumnBytes(col, b)
+	return b
+}
@@ -0,0 +1,158 @@
+package extension_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+func TestOutboxDelivery(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		// online is published before the broker goes down, nothing when empty
+		// as the broker is down from the start
+		online []string
+	}{
+		{name: "broker down at creation"},
+		{name: "resume after reconnect", online: []string{"0"}},
+		{name: "resume after reconnect mqtt5", options: ", protocol_version=5", online: []string{"0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			tcp := listeners.Config{ID: "tcp", Address: addr}
+			conn := openDB(t, filepath.Join(t.TempDir(), "outbox.db"))
+
+			s := newServer(t)
+			r := record(t, s, "ob/#")
+			if len(tt.online) > 0 {
+				serve(t, s, listeners.NewTCP(tcp))
+			}
+			mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://%s', outbox_table=mqtt_outbox, connect_retry_interval=100, max_reconnect_interval=100%s)", addr, tt.options))
+			if len(tt.online) > 0 {
+				for _, payload := range tt.online {
+					mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', ?)", payload)
+				}
+				if got := r.waitUntil(t, tt.online[len(tt.online)-1]); len(got) != len(tt.online)-1 {
+					t.Fatalf("published %q before the broker went down", got)
+				}
+				s.Close()
+				waitFor(t, "disconnection", func() bool {
+					return queryInt(t, conn, "SELECT count(*) FROM mqtt_connections WHERE virtual_table = 'pub' AND connected") == 0
+				})
+				s = newServer(t)
+				r = record(t, s, "ob/#")
+			}
+
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', '1')")
+			mustExec(t, conn, "BEGIN")
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/2', '2')")
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', '3')")
+			mustExec(t, conn, "COMMIT")
+			mustExec(t, conn, "BEGIN")
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'rolled back')")
+			mustExec(t, conn, "ROLLBACK")
+			if n := queryInt(t, conn, "SELECT count(*) FROM mqtt_outbox WHERE status = 'pending'"); n != 3 {
+				t.Fatalf("%d pending messages while the broker is down, want 3", n)
+			}
+
+			serve(t, s, listeners.NewTCP(tcp))
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'end')")
+			want := []string{"1", "2", "3"}
+			if got := r.waitUntil(t, "end"); !slices.Equal(got, want) {
+				t.Errorf("delivered %q, want %q", got, want)
+			}
+			waitFor(t, "delivered rows", func() bool {
+				return queryInt(t, conn, "SELECT count(*) FROM mqtt_outbox WHERE status <> 'delivered'") == 0
+			})
+		})
+	}
+}
+
+func TestOutboxApplicationTransaction(t *testing.T) {
+	s, addr := newBroker(t)
+	r := record(t, s, "ob/#")
+	conn := openDB(t, filepath.Join(t.TempDir(), "outbox.db"))
+	mustExec(t, conn, "PRAGMA journal_mode = WAL")
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://%s', outbox_table=mqtt_outbox)", addr))
+	mustExec(t, conn, "CREATE TABLE orders(id INTEGER)")
+
+	// the committed message is delivered while the application holds a
+	// transaction, which the outbox neither joins nor waits for
+	mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'first')")
+	mustExec(t, conn, "BEGIN")
+	mustExec(t, conn, "INSERT INTO orders VALUES(1)")
+	mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'rolled back')")
+	r.waitUntil(t, "first")
+	mustExec(t, conn, "ROLLBACK")
+	mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'committed')")
+	r.waitUntil(t, "committed")
+	waitFor(t, "delivered rows", func() bool {
+		return queryInt(t, conn, "SELECT count(*) FROM mqtt_outbox WHERE status = 'delivered'") == 2
+	})
+	if got := r.list(); slices.Contains(got, "rolled back") {
+		t.Errorf("delivered %q", got)
+	}
+	if n := queryInt(t, conn, "SELECT count(*) FROM orders"); n != 0 {
+		t.Errorf("%d orders after ROLLBACK, want 0", n)
+	}
+}
+
+func TestOutboxMaxAttempts(t *testing.T) {
+	s, addr := newBroker(t)
+	r := record(t, s, "ob/#")
+	conn := openDB(t, filepath.Join(t.TempDir(), "outbox.db"))
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://%s', outbox_table=mqtt_outbox, max_attempts=1, outbox_retention=0)", addr))
+
+	// MQTT 3 clients can't send user properties
+	mustExec(t, conn, `INSERT INTO mqtt_outbox(topic, payload, properties) VALUES('ob/1', 'rejected', '{"k":"v"}')`)
+	mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ob/1', 'next')")
+	if got := r.waitUntil(t, "next"); len(got) != 0 {
+		t.Errorf("delivered %q before the next message", got)
+	}
+	waitFor(t, "pruned rows", func() bool {
+		return queryInt(t, conn, "SELECT count(*) FROM mqtt_outbox") == 1
+	})
+	if n := queryInt(t, conn, "SELECT count(*) FROM mqtt_outbox WHERE payload = 'rejected' AND status = 'failed' AND attempts = 1 AND error LIKE '%MQTT 5%'"); n != 1 {
+		t.Error("the rejected message is not marked as failed")
+	}
+}
+
+func TestOutboxOptionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		err     string
+	}{
+		{
+			name:    "in-memory database",
+			options: "outbox_table=mqtt_outbox",
+			err:     "is not stored in a file",
+		},
+		{
+			name:    "max_attempts without outbox",
+			options: "max_attempts=3",
+			err:     `"max_attempts" requires "outbox_table"`,
+		},
+		{
+			name:    "negative retention",
+			options: "outbox_table=mqtt_outbox, outbox_retention=-1",
+			err:     `invalid "outbox_retention" option`,
+		},
+	}
+	conn := openDB(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := conn.ExecContext(context.Background(), "CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://127.0.0.1:1883', "+tt.options+")")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package extension
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/walterwanderley/sqlite"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// loadProfile returns the options of a virtual table, with the settings of the
+// profile option read from the profiles table. Every column of the profile row,
+// except name, is an option and NULL columns are skipped. Options given inline
+// override the ones of the profile.
+func loadProfile(conn *sqlite.Conn, opts []string) ([]string, error) {
+	var (
+		profile string
+		table   = config.DefaultProfilesTable
+		inline  = make([]string, 0, len(opts))
+		keys    = make(map[string]bool)
+	)
+	for _, opt := range opts {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok {
+			// reported by the option parser
+			inline = append(inline, opt)
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		switch k {
+		case config.Profile:
+			profile = sanitizeOptionValue(v)
+		case config.ProfilesTable:
+			table = sanitizeOptionValue(v)
+		default:
+			keys[k] = true
+			inline = append(inline, opt)
+		}
+	}
+	if profile == "" {
+		return inline, nil
+	}
+	if !tableNameValid(table) {
+		return nil, fmt.Errorf("table name %q is invalid", table)
+	}
+
+	var (
+		found    bool
+		settings []string
+	)
+	err := conn.Exec(fmt.Sprintf("SELECT * FROM %s WHERE name = ?", table), func(stmt *sqlite.Stmt) error {
+		found = true
+		for i := range stmt.ColumnCount() {
+			k := strings.ToLower(stmt.ColumnName(i))
+			if k == "name" || keys[k] || stmt.ColumnType(i) == sqlite.SQLITE_NULL {
+				continue
+			}
+			// the values are taken literally, not expanded like the inline ones
+			v := strings.ReplaceAll(stmt.ColumnText(i), "$", "$$")
+			settings = append(settings, k+"="+v)
+		}
+		return nil
+	}, profile)
+	if err != nil {
+		return nil, fmt.Errorf("loading profile %q from %s: %w", profile, table, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("profile %q not found in %s", profile, table)
+	}
+	return append(settings, inline...), nil
+}
@@ -0,0 +1,36 @@
+package extension_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestResolveOptionsPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		want    string
+	}{
+		{name: "profile", options: "profile=dev", want: "from_profile"},
+		{name: "profile url", options: "profile=dev_url", want: "from_profile_url"},
+		{name: "url over profile", options: "profile=dev, url='tcp://{addr}?client_id=from_url'", want: "from_url"},
+		{name: "inline over url", options: "profile=dev_url, url='tcp://{addr}?client_id=from_url', client_id=inline", want: "inline"},
+		{name: "inline over profile", options: "profile=dev, client_id=inline_profile", want: "inline_profile"},
+	}
+	s, addr := newBroker(t)
+	conn := openDB(t, "")
+	mustExec(t, conn, "CREATE TABLE mqtt_profiles(name TEXT PRIMARY KEY, url TEXT, servers TEXT, client_id TEXT)")
+	mustExec(t, conn, "INSERT INTO mqtt_profiles VALUES('dev', NULL, ?, 'from_profile')", "tcp://"+addr)
+	mustExec(t, conn, "INSERT INTO mqtt_profiles VALUES('dev_url', ?, NULL, 'from_profile_url')", "tcp://"+addr)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := strings.ReplaceAll(tt.options, "{addr}", addr)
+			mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(%s)", options))
+			defer mustExec(t, conn, "DROP TABLE temp.pub")
+			if _, ok := s.Clients.Get(tt.want); !ok {
+				t.Errorf("client %q not connected", tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package extension
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// parseUserProperties decodes a JSON object into MQTT 5 user properties.
+// An array value sends the same key once for each element.
+func parseUserProperties(s string) ([]userProperty, error) {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(s), &obj); err != nil {
+		return nil, fmt.Errorf("properties must be a JSON object: %w", err)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	props := make([]userProperty, 0, len(obj))
+	for _, k := range keys {
+		values, ok := obj[k].([]any)
+		if !ok {
+			values = []any{obj[k]}
+		}
+		for _, v := range values {
+			s, err := userPropertyValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("property %q: %w", k, err)
+			}
+			props = append(props, userProperty{key: k, value: s})
+		}
+	}
+	return props, nil
+}
+
+func userPropertyValue(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// formatUserProperties encodes MQTT 5 user properties as a JSON object.
+// Keys sent more than once are grouped into an array.
+func formatUserProperties(props []userProperty) (string, error) {
+	obj := make(map[string]any, len(props))
+	for _, p := range props {
+		switch v := obj[p.key].(type) {
+		case nil:
+			obj[p.key] = p.value
+		case string:
+			obj[p.key] = []string{v, p.value}
+		case []string:
+			obj[p.key] = append(v, p.value)
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,67 @@
+package extension
+
+import (
+	"fmt"
+
+	"github.com/walterwanderley/sqlite"
+)
+
+// Publish implements mqtt_publish(connection, topic, payload [, qos, retained]).
+// The message is sent right away through the client of the publisher virtual table
+// named by connection, optionally qualified by its schema, on the calling database
+// connection. The function returns the message id (0 for QoS 0).
+type Publish struct {
+	// conn identifies the database connection the function is registered on
+	conn uint64
+}
+
+func (m *Publish) Args() int {
+	return -1
+}
+
+func (m *Publish) Deterministic() bool {
+	return false
+}
+
+func (m *Publish) Apply(ctx *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 3 || len(values) > 5 {
+		ctx.ResultError(fmt.Errorf("mqtt_publish expects (connection, topic, payload [, qos, retained])"))
+		return
+	}
+	name := values[0].Text()
+	vt, _, ok := publishers.lookup(m.conn, name)
+	if !ok {
+		ctx.ResultError(fmt.Errorf("publisher virtual table %q not found", name))
+		return
+	}
+	topic := values[1].Text()
+	if topic == "" {
+		ctx.ResultError(fmt.Errorf("topic is required"))
+		return
+	}
+	msg := message{
+		topic:   topic,
+		payload: values[2].Blob(),
+	}
+	if len(values) > 3 {
+		qos := values[3].Int()
+		if qos < 0 || qos > 2 {
+			ctx.ResultError(fmt.Errorf("QoS must be the number 0, 1 or 2"))
+			return
+		}
+		msg.qos = byte(qos)
+	}
+	if len(values) > 4 {
+		msg.retained = values[4].Int() > 0
+	}
+
+	if !vt.client.IsConnected() {
+		ctx.ResultError(fmt.Errorf("publisher error: %w", errNotConnected))
+		return
+	}
+	if err := vt.client.Publish(&msg); err != nil {
+		ctx.ResultError(fmt.Errorf("publisher error: %w", err))
+		return
+	}
+	ctx.ResultInt64(int64(msg.messageID))
+}
@@ -1,22 +1,20 @@
 package extension
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"net/url"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/walterwanderley/sqlite"
 
 	"github.com/litesql/mqtt/config"
 )
 
+// pendingTableName is the TEMP table tracking messages inserted inside a transaction
+const pendingTableName = "mqtt_pub_pending"
+
 type PublisherModule struct {
+	// conn identifies the database connection the module is registered on
+	conn uint64
 }
 
 func (m *PublisherModule) Connect(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
@@ -25,120 +23,54 @@ func (m *PublisherModule) Connect(conn *sqlite.Conn, args []string, declare func
 		virtualTableName = config.DefaultPublisherVTabName
 	}
 
-	var (
-		clientOptions = mqtt.NewClientOptions()
-
-		certFilePath    string
-		certKeyFilePath string
-		caFilePath      string
-		insecure        bool
-
-		err    error
-		logger string
-	)
-	if len(args) > 3 {
-		for _, opt := range args[3:] {
-			k, v, ok := strings.Cut(opt, "=")
-			if !ok {
-				return nil, fmt.Errorf("invalid option: %q", opt)
-			}
-			k = strings.TrimSpace(k)
-			v = sanitizeOptionValue(v)
-
-			switch strings.ToLower(k) {
-			case config.ClientID:
-				clientOptions.ClientID = v
-			case config.Timeout:
-				i, err := strconv.Atoi(v)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %w", k, err)
-				}
-				timeout := time.Duration(i) * time.Millisecond
-				clientOptions.PingTimeout = timeout
-				clientOptions.WriteTimeout = timeout
-			case config.KeepAlive:
-				i, err := strconv.ParseInt(v, 10, 64)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %w", k, err)
-				}
-				clientOptions.KeepAlive = i
-			case config.Servers:
-				serverList := strings.Split(v, ",")
-				for _, server := range serverList {
-					server = strings.TrimSpace(server)
-					u, err := url.Parse(server)
-					if err != nil {
-						return nil, fmt.Errorf("invalid %q option: %w", k, err)
-					}
-					clientOptions.Servers = append(clientOptions.Servers, u)
-				}
-			case config.Username:
-				clientOptions.Username = v
-			case config.Password:
-				clientOptions.Password = v
-			case config.CertFile:
-				certFilePath = v
-			case config.CertKeyFile:
-				certKeyFilePath = v
-			case config.CertCAFile:
-				caFilePath = v
-			case config.Insecure:
-				insecure, err = strconv.ParseBool(v)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %v", k, err)
-				}
-			case config.Storage:
-				if v != "" {
-					clientOptions.SetStore(mqtt.NewFileStore(v))
-				}
-			case config.Logger:
-				logger = v
-			default:
-				return nil, fmt.Errorf("unknown option: %s", k)
-			}
-		}
+	opts, err := resolveOptions(conn, args[3:])
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseOptions(config.DefaultPublisherVTabName, opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newClientConfig(values)
+	if err != nil {
+		return nil, err
 	}
 
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: insecure,
+	err = conn.Exec(fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s(schema TEXT, vtab TEXT, id INTEGER)", pendingTableName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating %q table: %w", pendingTableName, err)
 	}
 
-	if certFilePath != "" && certKeyFilePath != "" {
-		clientCert, err := tls.LoadX509KeyPair(certFilePath, certKeyFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("error loading client certificate: %w", err)
+	for _, name := range []string{config.MaxAttempts, config.OutboxRetention} {
+		if values.integer(name) < 0 {
+			return nil, fmt.Errorf("invalid %q option: must be a positive number", name)
+		}
+		if values.has(name) && !values.has(config.OutboxTable) {
+			return nil, fmt.Errorf("%q requires %q", name, config.OutboxTable)
 		}
-		tlsConfig.Certificates = []tls.Certificate{clientCert}
 	}
 
-	if caFilePath != "" {
-		caCertPEM, err := os.ReadFile(caFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("error loading CA certificate: %w", err)
+	var ob *outbox
+	if outboxTable := values.get(config.OutboxTable); outboxTable != "" {
+		if !tableNameValid(outboxTable) {
+			return nil, fmt.Errorf("table name %q is invalid", outboxTable)
 		}
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCertPEM) {
-			return nil, fmt.Errorf("error appending CA certificate to pool")
+		retention := time.Duration(values.integer(config.OutboxRetention)) * time.Second
+		ob, err = newOutbox(conn, outboxTable, values.integer(config.MaxAttempts), retention)
+		if err != nil {
+			return nil, err
 		}
-		tlsConfig.RootCAs = caCertPool
 	}
 
-	clientOptions = clientOptions.SetTLSConfig(&tlsConfig)
-
-	vtab, err := NewPublisherVirtualTable(virtualTableName, clientOptions, logger)
+	vtab, err := NewPublisherVirtualTable(args[1], virtualTableName, cfg, conn, ob, values.get(config.Logger))
 	if err != nil {
+		if ob != nil {
+			ob.close()
+		}
 		return nil, err
 	}
+	publishers.add(vtab, tableID{conn: m.conn, schema: args[1], name: virtualTableName})
 
 	return vtab,
-		declare("CREATE TABLE x(topic TEXT, payload BLOB, qos INTEGER, retained INTEGER)")
-}
-
-func sanitizeOptionValue(v string) string {
-	v = strings.TrimSpace(v)
-	v = strings.TrimPrefix(v, "'")
-	v = strings.TrimSuffix(v, "'")
-	v = strings.TrimPrefix(v, "\"")
-	v = strings.TrimSuffix(v, "\"")
-	return os.ExpandEnv(v)
+		declare("CREATE TABLE x(topic TEXT, payload BLOB, qos INTEGER, retained INTEGER, properties TEXT, content_type TEXT, response_topic TEXT, correlation_data BLOB, message_expiry INTEGER, payload_format INTEGER)")
 }
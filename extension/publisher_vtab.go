@@ -1,24 +1,53 @@
 package extension
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"sync"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/walterwanderley/sqlite"
 )
 
+// publisherPropertyColumns are the MQTT 5 columns declared after topic, payload, qos and retained.
+var publisherPropertyColumns = []string{"properties", "content_type", "response_topic", "correlation_data", "message_expiry", "payload_format"}
+
+// publishers holds the connected publisher virtual tables, so that mqtt_publish
+// can send messages through the one named on the calling connection.
+var publishers tableRegistry[*PublisherVirtualTable]
+
 type PublisherVirtualTable struct {
-	client       mqtt.Client
+	client       client
+	schema       string
 	name         string
+	mqtt5        bool
+	conn         *sqlite.Conn
+	outbox       *outbox
 	logger       *slog.Logger
 	loggerCloser io.Closer
+	status       connStatus
+
+	// Messages inserted inside a transaction wait in pending until COMMIT.
+	// Their ids are also stored in the pendingTableName TEMP table, with the
+	// schema and name of the virtual table, so that ROLLBACK TO a savepoint
+	// discards them too.
+	pending   map[int64]*message
+	pendingID int64
+	// outgoing holds the messages collected by Sync, published by Commit
+	outgoing []*message
+	txMu     sync.Mutex
 }
 
-func NewPublisherVirtualTable(name string, clientOptions *mqtt.ClientOptions, loggerDef string) (*PublisherVirtualTable, error) {
+func NewPublisherVirtualTable(schema, name string, cfg clientConfig, conn *sqlite.Conn, ob *outbox, loggerDef string) (*PublisherVirtualTable, error) {
 	vtab := PublisherVirtualTable{
-		name: name,
+		schema:  schema,
+		name:    name,
+		mqtt5:   cfg.protocolVersion == protocolV5,
+		conn:    conn,
+		outbox:  ob,
+		pending: make(map[int64]*message),
 	}
 
 	logger, loggerCloser, err := loggerFromConfig(loggerDef)
@@ -28,21 +57,26 @@ func NewPublisherVirtualTable(name string, clientOptions *mqtt.ClientOptions, lo
 	vtab.loggerCloser = loggerCloser
 	vtab.logger = logger
 
-	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetConnectionLostHandler(vtab.onConnectionLost)
-	clientOptions.SetOnConnectHandler(vtab.onConnectHandler)
-
-	client := mqtt.NewClient(clientOptions)
+	cfg.onConnect = vtab.onConnectHandler
+	cfg.onConnectionLost = vtab.onConnectionLost
+	cfg.onConnectError = vtab.status.down
 
-	if len(clientOptions.Servers) != 0 {
-		tok := client.Connect()
-		if tok.Wait() && tok.Error() != nil {
-			return nil, fmt.Errorf("connecting to mqtt server: %w", tok.Error())
-		}
+	client, err := acquireClient(cfg, logger, name)
+	if err != nil {
+		return nil, err
 	}
 
 	vtab.client = client
 
+	if err := connect(client, cfg, logger, name); err != nil {
+		client.Disconnect()
+		return nil, err
+	}
+
+	if vtab.outbox != nil {
+		vtab.outbox.start(client, logger)
+	}
+
 	return &vtab, nil
 }
 
@@ -56,15 +90,20 @@ func (vt *PublisherVirtualTable) Open() (sqlite.VirtualCursor, error) {
 
 func (vt *PublisherVirtualTable) Disconnect() error {
 	var err error
+	publishers.remove(vt)
+	if vt.outbox != nil {
+		err = vt.outbox.close()
+	}
+	vt.client.Disconnect()
 	if vt.loggerCloser != nil {
-		err = vt.loggerCloser.Close()
+		err = errors.Join(err, vt.loggerCloser.Close())
 	}
-	vt.client.Disconnect(200)
 	return err
 }
 
+// Destroy releases the client, DROP TABLE does not call Disconnect.
 func (vt *PublisherVirtualTable) Destroy() error {
-	return nil
+	return vt.Disconnect()
 }
 
 func (vt *PublisherVirtualTable) Insert(values ...sqlite.Value) (int64, error) {
@@ -72,7 +111,7 @@ func (vt *PublisherVirtualTable) Insert(values ...sqlite.Value) (int64, error) {
 	if topic == "" {
 		return 0, fmt.Errorf("topic is required")
 	}
-	payload := values[1].Text()
+	payload := values[1].Blob()
 	qos := values[2].Int()
 	if qos < 0 || qos > 2 {
 		return 0, fmt.Errorf("QoS must be the number 0, 1 or 2")
@@ -80,14 +119,92 @@ func (vt *PublisherVirtualTable) Insert(values ...sqlite.Value) (int64, error) {
 
 	retained := values[3].Int() > 0
 
-	tok := vt.client.Publish(topic, byte(qos), retained, payload)
-	if tok.Wait() && tok.Error() != nil {
-		return 0, fmt.Errorf("publisher error: %w", tok.Error())
+	properties, err := vt.messageProperties(values[4:])
+	if err != nil {
+		return 0, err
+	}
+
+	msg := message{
+		topic:      topic,
+		payload:    payload,
+		qos:        byte(qos),
+		retained:   retained,
+		properties: properties,
+	}
+
+	// with an outbox the message is delivered in the background once committed
+	if vt.outbox != nil {
+		if err := vt.outbox.enqueue(&msg); err != nil {
+			return 0, fmt.Errorf("outbox error: %w", err)
+		}
+		return 1, nil
 	}
 
+	// even outside an explicit transaction the statement may still fail on a
+	// later row, SQLite calls Begin, Sync and Commit for it all the same
+	vt.txMu.Lock()
+	defer vt.txMu.Unlock()
+	vt.pendingID++
+	err = vt.conn.Exec(fmt.Sprintf("INSERT INTO temp.%s(schema, vtab, id) VALUES(?, ?, ?)", pendingTableName), nil, vt.schema, vt.name, vt.pendingID)
+	if err != nil {
+		return 0, fmt.Errorf("buffering message: %w", err)
+	}
+	vt.pending[vt.pendingID] = &msg
+
 	return 1, nil
 }
 
+// messageProperties reads the MQTT 5 columns: properties, content_type, response_topic,
+// correlation_data, message_expiry and payload_format.
+func (vt *PublisherVirtualTable) messageProperties(values []sqlite.Value) (*messageProperties, error) {
+	var (
+		props messageProperties
+		set   bool
+	)
+	for i, v := range values {
+		if v.Type() == sqlite.SQLITE_NULL {
+			continue
+		}
+		column := publisherPropertyColumns[i]
+		if !vt.mqtt5 {
+			return nil, errRequiresV5(column)
+		}
+		set = true
+		switch column {
+		case "properties":
+			user, err := parseUserProperties(v.Text())
+			if err != nil {
+				return nil, err
+			}
+			props.user = user
+		case "content_type":
+			props.contentType = v.Text()
+		case "response_topic":
+			props.responseTopic = v.Text()
+		case "correlation_data":
+			props.correlationData = v.Blob()
+		case "message_expiry":
+			expiry := v.Int64()
+			if expiry < 0 || expiry > math.MaxUint32 {
+				return nil, fmt.Errorf("message_expiry must be between 0 and %d seconds", uint32(math.MaxUint32))
+			}
+			messageExpiry := uint32(expiry)
+			props.messageExpiry = &messageExpiry
+		case "payload_format":
+			format := v.Int()
+			if format != 0 && format != 1 {
+				return nil, fmt.Errorf("payload_format must be the number 0 (bytes) or 1 (UTF-8)")
+			}
+			payloadFormat := byte(format)
+			props.payloadFormat = &payloadFormat
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+	return &props, nil
+}
+
 func (vt *PublisherVirtualTable) Update(_ sqlite.Value, _ ...sqlite.Value) error {
 	return fmt.Errorf("UPDATE operations on %q are not supported", vt.name)
 }
@@ -100,10 +217,72 @@ func (vt *PublisherVirtualTable) Delete(_ sqlite.Value) error {
 	return fmt.Errorf("DELETE operations on %q are not supported", vt.name)
 }
 
-func (vt *PublisherVirtualTable) onConnectionLost(client mqtt.Client, err error) {
+func (vt *PublisherVirtualTable) Begin() error {
+	vt.txMu.Lock()
+	defer vt.txMu.Unlock()
+	clear(vt.pending)
+	vt.outgoing = nil
+	return nil
+}
+
+// Sync collects the messages that survived any ROLLBACK TO. It fails, rolling back
+// the whole transaction, when there are messages to send and the broker is unreachable.
+func (vt *PublisherVirtualTable) Sync() error {
+	vt.txMu.Lock()
+	defer vt.txMu.Unlock()
+	if len(vt.pending) == 0 {
+		return nil
+	}
+	if !vt.client.IsConnected() {
+		return fmt.Errorf("publisher error: %w", errNotConnected)
+	}
+
+	err := vt.conn.Exec(fmt.Sprintf("SELECT id FROM temp.%s WHERE schema = ? AND vtab = ? ORDER BY id", pendingTableName), func(stmt *sqlite.Stmt) error {
+		if msg, ok := vt.pending[stmt.ColumnInt64(0)]; ok {
+			vt.outgoing = append(vt.outgoing, msg)
+		}
+		return nil
+	}, vt.schema, vt.name)
+	if err != nil {
+		return fmt.Errorf("reading buffered messages: %w", err)
+	}
+	clear(vt.pending)
+	return vt.conn.Exec(fmt.Sprintf("DELETE FROM temp.%s WHERE schema = ? AND vtab = ?", pendingTableName), nil, vt.schema, vt.name)
+}
+
+func (vt *PublisherVirtualTable) Commit() error {
+	vt.txMu.Lock()
+	defer vt.txMu.Unlock()
+	for _, msg := range vt.outgoing {
+		if err := vt.client.Publish(msg); err != nil {
+			vt.logger.Error("publish on commit", "virtual_table", vt.name, "topic", msg.topic, "error", err)
+		}
+	}
+	vt.outgoing = nil
+	// the messages of the transaction are now visible to the outbox
+	if vt.outbox != nil {
+		vt.outbox.notify()
+	}
+	return nil
+}
+
+func (vt *PublisherVirtualTable) Rollback() error {
+	vt.txMu.Lock()
+	defer vt.txMu.Unlock()
+	clear(vt.pending)
+	vt.outgoing = nil
+	return nil
+}
+
+func (vt *PublisherVirtualTable) onConnectionLost(err error) {
+	vt.status.down(err)
 	vt.logger.Error("lost connection to the broker", "virtual_table", vt.name, "error", err)
 }
 
-func (vt *PublisherVirtualTable) onConnectHandler(client mqtt.Client) {
+func (vt *PublisherVirtualTable) onConnectHandler() {
+	vt.status.up()
 	vt.logger.Debug("connected to broker", "virtual_table", vt.name)
+	if vt.outbox != nil {
+		vt.outbox.notify()
+	}
 }
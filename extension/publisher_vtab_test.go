@@ -0,0 +1,160 @@
+package extension_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPublisherTransactions(t *testing.T) {
+	s, addr := newBroker(t)
+	conn := openDB(t, "")
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://%s')", addr))
+	mustExec(t, conn, "CREATE TABLE orders(id INTEGER)")
+
+	tests := []struct {
+		name  string
+		stmts []string
+		want  []string
+	}{
+		{
+			name:  "autocommit",
+			stmts: []string{"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')"},
+			want:  []string{"a"},
+		},
+		{
+			name: "commit",
+			stmts: []string{
+				"BEGIN",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')",
+				"INSERT INTO orders VALUES(1)",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'b')",
+				"COMMIT",
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "rollback",
+			stmts: []string{
+				"BEGIN",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')",
+				"ROLLBACK",
+			},
+		},
+		{
+			name: "rollback to savepoint",
+			stmts: []string{
+				"BEGIN",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')",
+				"SAVEPOINT sp",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'b')",
+				"ROLLBACK TO sp",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'c')",
+				"RELEASE sp",
+				"COMMIT",
+			},
+			want: []string{"a", "c"},
+		},
+		{
+			name: "released savepoint",
+			stmts: []string{
+				"SAVEPOINT sp",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')",
+				"RELEASE sp",
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "rollback after release",
+			stmts: []string{
+				"BEGIN",
+				"SAVEPOINT sp",
+				"INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')",
+				"RELEASE sp",
+				"ROLLBACK",
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := fmt.Sprintf("tx/%d", i)
+			r := record(t, s, topic)
+			for _, stmt := range tt.stmts {
+				mustExec(t, conn, stmt, topic)
+			}
+			// messages from the same client arrive in order, the marker comes last
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES(?, 'end')", topic)
+			if got := r.waitUntil(t, "end"); !slices.Equal(got, tt.want) {
+				t.Errorf("published %q, want %q", got, tt.want)
+			}
+			if n := queryInt(t, conn, "SELECT count(*) FROM temp.mqtt_pub_pending"); n != 0 {
+				t.Errorf("%d messages left pending", n)
+			}
+		})
+	}
+}
+
+func TestPublisherFailedStatement(t *testing.T) {
+	s, addr := newBroker(t)
+	conn := openDB(t, "")
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(servers='tcp://%s')", addr))
+
+	// the second row of the statement is rejected, so the first one is not published
+	const failing = "INSERT INTO temp.pub(topic, payload) VALUES(?1, 'b'), ('', 'c')"
+	tests := []struct {
+		name          string
+		before, after []string
+		want          []string
+	}{
+		{name: "autocommit"},
+		{
+			name:   "transaction",
+			before: []string{"BEGIN", "INSERT INTO temp.pub(topic, payload) VALUES(?1, 'a')"},
+			after:  []string{"COMMIT"},
+			want:   []string{"a"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := fmt.Sprintf("fail/%d", i)
+			r := record(t, s, topic)
+			for _, stmt := range tt.before {
+				mustExec(t, conn, stmt, topic)
+			}
+			if _, err := conn.ExecContext(context.Background(), failing, topic); err == nil {
+				t.Fatal("the statement did not fail")
+			}
+			for _, stmt := range tt.after {
+				mustExec(t, conn, stmt, topic)
+			}
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES(?, 'end')", topic)
+			if got := r.waitUntil(t, "end"); !slices.Equal(got, tt.want) {
+				t.Errorf("published %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisherSameNameSchemas(t *testing.T) {
+	s, addr := newBroker(t)
+	r := record(t, s, "schemas/#")
+	conn := openDB(t, "")
+	mustExec(t, conn, "ATTACH ':memory:' AS aux")
+	for _, schema := range []string{"main", "aux"} {
+		mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE %s.pub USING mqtt_pub(servers='tcp://%s')", schema, addr))
+	}
+
+	mustExec(t, conn, "BEGIN")
+	mustExec(t, conn, "INSERT INTO main.pub(topic, payload) VALUES('schemas/main', 'main')")
+	mustExec(t, conn, "INSERT INTO aux.pub(topic, payload) VALUES('schemas/aux', 'aux')")
+	mustExec(t, conn, "COMMIT")
+	mustExec(t, conn, "INSERT INTO main.pub(topic, payload) VALUES('schemas/main', 'end')")
+
+	// the virtual tables commit in no particular order
+	got := r.waitUntil(t, "end")
+	slices.Sort(got)
+	if want := []string{"aux", "main"}; !slices.Equal(got, want) {
+		t.Errorf("published %q, want %q", got, want)
+	}
+}
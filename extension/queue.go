@@ -0,0 +1,376 @@
+package extension
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	overflowBlock      = "block"
+	overflowDropOldest = "drop_oldest"
+	overflowDropNewest = "drop_newest"
+	overflowSpill      = "spill_to_disk"
+)
+
+func parseOverflowPolicy(v string) (string, error) {
+	switch v {
+	case overflowBlock, overflowDropOldest, overflowDropNewest, overflowSpill:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported policy %q, use %s, %s, %s or %s", v, overflowBlock, overflowDropOldest, overflowDropNewest, overflowSpill)
+	}
+}
+
+// messageQueue is a FIFO between the MQTT client callbacks and the goroutine
+// writing the incoming messages to the database, unbounded with size 0. The
+// overflow policy decides what happens to a message arriving when it is full.
+type messageQueue struct {
+	size     int
+	policy   string
+	spillDir string
+	logger   *slog.Logger
+
+	items    []*message
+	closed   bool
+	dropped  uint64
+	spill    *spillFile
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+type queueStats struct {
+	Size    int    `json:"queue_size"`
+	Depth   int    `json:"queue_depth"`
+	Spilled int    `json:"spilled"`
+	Dropped uint64 `json:"dropped"`
+}
+
+func newMessageQueue(size int, policy string, spillDir string, logger *slog.Logger) *messageQueue {
+	q := messageQueue{
+		size:     size,
+		policy:   policy,
+		spillDir: spillDir,
+		logger:   logger,
+		items:    make([]*message, 0, size),
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return &q
+}
+
+// push adds the message to the queue, applying the overflow policy when it is full.
+// The messages dropped by the policy are acknowledged, as they are not stored by
+// choice: otherwise ack=after_commit would never acknowledge them.
+func (q *messageQueue) push(msg *message) {
+	q.mu.Lock()
+	dropped := q.add(msg)
+	q.mu.Unlock()
+	acknowledge(dropped)
+}
+
+// add queues the message, returning the messages dropped. The caller must hold mu.
+func (q *messageQueue) add(msg *message) []*message {
+	// once messages are spilled the newer ones follow them to keep the order
+	if q.spill != nil && q.spill.count > 0 {
+		return q.spillMessage(msg)
+	}
+	var dropped []*message
+	for q.size > 0 && len(q.items) >= q.size && !q.closed {
+		switch q.policy {
+		case overflowDropOldest:
+			dropped = append(dropped, q.items[0])
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.dropped++
+		case overflowDropNewest:
+			q.dropped++
+			return append(dropped, msg)
+		case overflowSpill:
+			return q.spillMessage(msg)
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		// not acknowledged, the broker redelivers it to the next session
+		q.dropped++
+		return dropped
+	}
+	q.items = append(q.items, msg)
+	q.notEmpty.Signal()
+	return dropped
+}
+
+// pop waits for the next message. It returns false once the queue is closed and empty.
+func (q *messageQueue) pop() (*message, bool) {
+	q.mu.Lock()
+	for len(q.items) == 0 && q.spilled() == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	var dropped []*message
+	if len(q.items) == 0 && q.spilled() > 0 {
+		dropped = q.unspill()
+	}
+	if len(q.items) == 0 {
+		q.mu.Unlock()
+		acknowledge(dropped)
+		return nil, false
+	}
+	msg := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.notFull.Signal()
+	q.mu.Unlock()
+	acknowledge(dropped)
+	return msg, true
+}
+
+// acknowledge acknowledges the messages to the broker, outside of the queue lock.
+func acknowledge(msgs []*message) {
+	for _, msg := range msgs {
+		if msg.ack != nil {
+			msg.ack()
+		}
+	}
+}
+
+// close wakes up the writer to drain the queue and rejects new messages.
+func (q *messageQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// release removes the spill file. Call it after the queue is drained.
+func (q *messageQueue) release() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill == nil {
+		return nil
+	}
+	err := q.spill.remove()
+	q.spill = nil
+	return err
+}
+
+func (q *messageQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return queueStats{
+		Size:    q.size,
+		Depth:   len(q.items) + q.spilled(),
+		Spilled: q.spilled(),
+		Dropped: q.dropped,
+	}
+}
+
+func (q *messageQueue) spilled() int {
+	if q.spill == nil {
+		return 0
+	}
+	return q.spill.count
+}
+
+// spillMessage writes the message to the spill file, returning it if it was dropped instead.
+func (q *messageQueue) spillMessage(msg *message) []*message {
+	if q.spill == nil {
+		spill, err := newSpillFile(q.spillDir)
+		if err != nil {
+			q.dropped++
+			q.logger.Error("spill to disk", "error", err, "topic", msg.topic)
+			return []*message{msg}
+		}
+		q.spill = spill
+	}
+	if err := q.spill.write(msg); err != nil {
+		q.dropped++
+		q.logger.Error("spill to disk", "error", err, "topic", msg.topic)
+		return []*message{msg}
+	}
+	q.notEmpty.Signal()
+	return nil
+}
+
+// unspill moves the oldest spilled messages back to the queue, returning the
+// messages dropped when the file can't be read.
+func (q *messageQueue) unspill() []*message {
+	for len(q.items) < q.size && q.spill.count > 0 {
+		msg, err := q.spill.read()
+		if err != nil {
+			q.dropped += uint64(q.spill.count)
+			q.logger.Error("read spilled messages", "error", err, "dropped", q.spill.count)
+			dropped := q.spill.unread()
+			if err := q.spill.reset(); err != nil {
+				q.logger.Error("reset spill file", "error", err)
+			}
+			return dropped
+		}
+		q.items = append(q.items, msg)
+	}
+	if q.spill.count == 0 {
+		if err := q.spill.reset(); err != nil {
+			q.logger.Error("reset spill file", "error", err)
+		}
+	}
+	return nil
+}
+
+// spillFile stores the messages that overflow the queue as JSON lines. Their
+// acknowledgement callbacks stay in memory, in the same order, so the messages
+// are acknowledged once stored and redelivered by the broker after a crash.
+type spillFile struct {
+	f      *os.File
+	reader *bufio.Reader
+	size   int64
+	count  int
+	acks   []func()
+}
+
+type spilledMessage struct {
+	MessageID              uint16  `json:"message_id"`
+	Topic                  string  `json:"topic"`
+	Payload                []byte  `json:"payload"`
+	QoS                    byte    `json:"qos"`
+	Retained               bool    `json:"retained,omitempty"`
+	Duplicate              bool    `json:"duplicate,omitempty"`
+	Properties             string  `json:"properties,omitempty"`
+	ContentType            string  `json:"content_type,omitempty"`
+	ResponseTopic          string  `json:"response_topic,omitempty"`
+	CorrelationData        []byte  `json:"correlation_data,omitempty"`
+	MessageExpiry          *uint32 `json:"message_expiry,omitempty"`
+	PayloadFormat          *byte   `json:"payload_format,omitempty"`
+	SubscriptionIdentifier *int    `json:"subscription_identifier,omitempty"`
+	HasProperties          bool    `json:"has_properties,omitempty"`
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, "mqtt-spill-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{
+		f:      f,
+		reader: bufio.NewReader(f),
+	}, nil
+}
+
+func (s *spillFile) write(msg *message) error {
+	sm := spilledMessage{
+		MessageID: msg.messageID,
+		Topic:     msg.topic,
+		Payload:   msg.payload,
+		QoS:       msg.qos,
+		Retained:  msg.retained,
+		Duplicate: msg.duplicate,
+	}
+	if props := msg.properties; props != nil {
+		sm.HasProperties = true
+		if len(props.user) > 0 {
+			user, err := formatUserProperties(props.user)
+			if err != nil {
+				return err
+			}
+			sm.Properties = user
+		}
+		sm.ContentType = props.contentType
+		sm.ResponseTopic = props.responseTopic
+		sm.CorrelationData = props.correlationData
+		sm.MessageExpiry = props.messageExpiry
+		sm.PayloadFormat = props.payloadFormat
+		sm.SubscriptionIdentifier = props.subscriptionIdentifier
+	}
+	b, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	// WriteAt leaves the file offset used by the reader untouched
+	n, err := s.f.WriteAt(append(b, '\n'), s.size)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	s.count++
+	s.acks = append(s.acks, msg.ack)
+	return nil
+}
+
+func (s *spillFile) read() (*message, error) {
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var sm spilledMessage
+	if err := json.Unmarshal(line, &sm); err != nil {
+		return nil, err
+	}
+	msg := message{
+		messageID: sm.MessageID,
+		topic:     sm.Topic,
+		payload:   sm.Payload,
+		qos:       sm.QoS,
+		retained:  sm.Retained,
+		duplicate: sm.Duplicate,
+	}
+	if sm.HasProperties {
+		msg.properties = &messageProperties{
+			contentType:            sm.ContentType,
+			responseTopic:          sm.ResponseTopic,
+			correlationData:        sm.CorrelationData,
+			messageExpiry:          sm.MessageExpiry,
+			payloadFormat:          sm.PayloadFormat,
+			subscriptionIdentifier: sm.SubscriptionIdentifier,
+		}
+		if sm.Properties != "" {
+			user, err := parseUserProperties(sm.Properties)
+			if err != nil {
+				return nil, err
+			}
+			msg.properties.user = user
+		}
+	}
+	s.count--
+	msg.ack = s.acks[0]
+	s.acks[0] = nil
+	s.acks = s.acks[1:]
+	return &msg, nil
+}
+
+// unread returns the messages not read back, holding only their acknowledgement.
+func (s *spillFile) unread() []*message {
+	msgs := make([]*message, 0, len(s.acks))
+	for _, ack := range s.acks {
+		msgs = append(msgs, &message{ack: ack})
+	}
+	return msgs
+}
+
+// reset empties the file once every spilled message was read back.
+func (s *spillFile) reset() error {
+	s.count = 0
+	s.size = 0
+	s.acks = nil
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader.Reset(s.f)
+	return nil
+}
+
+func (s *spillFile) remove() error {
+	name := s.f.Name()
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
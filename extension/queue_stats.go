@@ -0,0 +1,44 @@
+package extension
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/walterwanderley/sqlite"
+)
+
+// QueueStats implements mqtt_queue_stats(connection), returning a JSON object
+// with the size, depth and drop counter of the queue of a subscriber virtual table,
+// or NULL when the virtual table was created without queue_size.
+type QueueStats struct {
+	// conn identifies the database connection the function is registered on
+	conn uint64
+}
+
+func (m *QueueStats) Args() int {
+	return 1
+}
+
+func (m *QueueStats) Deterministic() bool {
+	return false
+}
+
+func (m *QueueStats) Apply(ctx *sqlite.Context, values ...sqlite.Value) {
+	name := values[0].Text()
+	vt, _, ok := subscribers.lookup(m.conn, name)
+	if !ok {
+		ctx.ResultError(fmt.Errorf("subscriber virtual table %q not found", name))
+		return
+	}
+	// without queue_size the queue is unbounded, not an empty one of size 0
+	if vt.queue.size == 0 {
+		ctx.ResultNull()
+		return
+	}
+	b, err := json.Marshal(vt.queue.stats())
+	if err != nil {
+		ctx.ResultError(err)
+		return
+	}
+	ctx.ResultText(string(b))
+}
@@ -0,0 +1,220 @@
+package extension
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acks records the topics of the acknowledged messages.
+type acks struct {
+	mu     sync.Mutex
+	topics []string
+}
+
+func (a *acks) message(topic string) *message {
+	return &message{
+		topic:   topic,
+		payload: []byte(topic),
+		ack: func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.topics = append(a.topics, topic)
+		},
+	}
+}
+
+func (a *acks) list() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.topics)
+}
+
+// popAll closes the queue and returns the topics of the remaining messages.
+func popAll(q *messageQueue) []string {
+	q.close()
+	var topics []string
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			return topics
+		}
+		topics = append(topics, msg.topic)
+	}
+}
+
+func newTestQueue(t *testing.T, size int, policy string) *messageQueue {
+	t.Helper()
+	q := newMessageQueue(size, policy, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() {
+		if err := q.release(); err != nil {
+			t.Error(err)
+		}
+	})
+	return q
+}
+
+func TestMessageQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy  string
+		size    int
+		want    []string
+		acked   []string
+		dropped uint64
+	}{
+		{
+			policy: overflowDropOldest,
+			size:   2,
+			want:   []string{"m3", "m4"},
+			// not stored by choice, so acknowledged right away
+			acked:   []string{"m1", "m2"},
+			dropped: 2,
+		},
+		{
+			policy:  overflowDropNewest,
+			size:    2,
+			want:    []string{"m1", "m2"},
+			acked:   []string{"m3", "m4"},
+			dropped: 2,
+		},
+		{
+			policy: overflowSpill,
+			size:   2,
+			want:   []string{"m1", "m2", "m3", "m4"},
+		},
+		{
+			policy: overflowBlock,
+			size:   0,
+			want:   []string{"m1", "m2", "m3", "m4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.policy, tt.size), func(t *testing.T) {
+			var a acks
+			q := newTestQueue(t, tt.size, tt.policy)
+			for i := 1; i <= 4; i++ {
+				q.push(a.message(fmt.Sprintf("m%d", i)))
+			}
+			if got := q.stats().Dropped; got != tt.dropped {
+				t.Errorf("dropped %d messages, want %d", got, tt.dropped)
+			}
+			if got := popAll(q); !slices.Equal(got, tt.want) {
+				t.Errorf("popped %q, want %q", got, tt.want)
+			}
+			if got := a.list(); !slices.Equal(got, tt.acked) {
+				t.Errorf("acknowledged %q, want %q", got, tt.acked)
+			}
+		})
+	}
+}
+
+func TestMessageQueueBlock(t *testing.T) {
+	var a acks
+	q := newTestQueue(t, 1, overflowBlock)
+	q.push(a.message("m1"))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(a.message("m2"))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if msg, ok := q.pop(); !ok || msg.topic != "m1" {
+		t.Fatalf("popped %v, want m1", msg)
+	}
+	<-pushed
+	if got := popAll(q); !slices.Equal(got, []string{"m2"}) {
+		t.Errorf("popped %q, want [m2]", got)
+	}
+}
+
+func TestMessageQueueClosed(t *testing.T) {
+	var a acks
+	q := newTestQueue(t, 1, overflowBlock)
+	q.push(a.message("m1"))
+	q.close()
+	// rejected without acknowledging it, the broker redelivers it
+	q.push(a.message("m2"))
+
+	if got := popAll(q); !slices.Equal(got, []string{"m1"}) {
+		t.Errorf("popped %q, want [m1]", got)
+	}
+	if got := a.list(); len(got) != 0 {
+		t.Errorf("acknowledged %q, want none", got)
+	}
+	if got := q.stats().Dropped; got != 1 {
+		t.Errorf("dropped %d messages, want 1", got)
+	}
+}
+
+func TestMessageQueueSpillOrder(t *testing.T) {
+	var a acks
+	q := newTestQueue(t, 2, overflowSpill)
+	var want []string
+	push := func(n int) {
+		for range n {
+			topic := fmt.Sprintf("m%d", len(want)+1)
+			want = append(want, topic)
+			q.push(a.message(topic))
+		}
+	}
+
+	push(5)
+	if s := q.stats(); s.Depth != 5 || s.Spilled != 3 {
+		t.Errorf("depth %d with %d spilled, want 5 with 3", s.Depth, s.Spilled)
+	}
+	// the messages arriving while others are spilled follow them, even with room in the queue
+	var got []string
+	for range 2 {
+		msg, _ := q.pop()
+		got = append(got, msg.topic)
+	}
+	push(2)
+	if s := q.stats(); s.Spilled != 5 {
+		t.Errorf("%d messages spilled, want 5", s.Spilled)
+	}
+
+	q.close()
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, msg.topic)
+		if string(msg.payload) != msg.topic {
+			t.Errorf("payload %q read back for %s", msg.payload, msg.topic)
+		}
+		// spilled messages keep their acknowledgement
+		msg.ack()
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("popped %q, want %q", got, want)
+	}
+	if acked := a.list(); !slices.Equal(acked, want[2:]) {
+		t.Errorf("acknowledged %q, want %q", acked, want[2:])
+	}
+	if s := q.stats(); s.Depth != 0 || s.Spilled != 0 {
+		t.Errorf("depth %d with %d spilled after draining, want 0", s.Depth, s.Spilled)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []string{overflowBlock, overflowDropOldest, overflowDropNewest, overflowSpill} {
+		if got, err := parseOverflowPolicy(policy); err != nil || got != policy {
+			t.Errorf("parseOverflowPolicy(%q) = %q, %v", policy, got, err)
+		}
+	}
+	want := `unsupported policy "spill", use block, drop_oldest, drop_newest or spill_to_disk`
+	if _, err := parseOverflowPolicy("spill"); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
@@ -7,15 +7,32 @@ import (
 )
 
 func registerFunc(api *sqlite.ExtensionApi) (sqlite.ErrorCode, error) {
-	if err := api.CreateModule(config.DefaultPublisherVTabName, &PublisherModule{}, sqlite.ReadOnly(false)); err != nil {
+	// the extension is registered once per database connection
+	conn := lastConnID.Add(1)
+	if err := api.CreateModule(config.DefaultPublisherVTabName, &PublisherModule{conn: conn}, sqlite.ReadOnly(false), sqlite.Transaction(true), sqlite.TwoPhaseCommit(true)); err != nil {
 		return sqlite.SQLITE_ERROR, err
 	}
-	if err := api.CreateModule(config.DefaultSubscriberVTabName, &SubscriberModule{}, sqlite.ReadOnly(false)); err != nil {
+	if err := createSubscriberModule(api, config.DefaultSubscriberVTabName, &SubscriberModule{conn: conn}); err != nil {
+		return sqlite.SQLITE_ERROR, err
+	}
+	if err := api.CreateModule("mqtt_connections", &ConnectionsModule{}, sqlite.EponymousOnly(true)); err != nil {
+		return sqlite.SQLITE_ERROR, err
+	}
+	if err := api.CreateModule("mqtt_options", &OptionsModule{}, sqlite.EponymousOnly(true)); err != nil {
 		return sqlite.SQLITE_ERROR, err
 	}
 	if err := api.CreateFunction("mqtt_info", &Info{}); err != nil {
 		return sqlite.SQLITE_ERROR, err
 	}
+	if err := api.CreateFunction("mqtt_publish", &Publish{conn: conn}); err != nil {
+		return sqlite.SQLITE_ERROR, err
+	}
+	if err := api.CreateFunction("mqtt_queue_stats", &QueueStats{conn: conn}); err != nil {
+		return sqlite.SQLITE_ERROR, err
+	}
+	if err := api.CreateFunction("mqtt_status", &Status{conn: conn}); err != nil {
+		return sqlite.SQLITE_ERROR, err
+	}
 
 	return sqlite.SQLITE_OK, nil
 }
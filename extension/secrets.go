@@ -0,0 +1,55 @@
+package extension
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// secretFile is a credential kept in a file, like a Docker or Kubernetes secret.
+// It is read on every connection attempt, so the secret can rotate without
+// recreating the virtual table. The last value read is used while the file
+// can't be read.
+type secretFile struct {
+	path  string
+	mu    sync.Mutex
+	value string
+}
+
+func newSecretFile(path string) (*secretFile, error) {
+	s := secretFile{path: path}
+	if _, err := s.read(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *secretFile) read() (string, error) {
+	data, err := os.ReadFile(s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		return s.value, fmt.Errorf("reading secret: %w", err)
+	}
+	// editors and echo leave a trailing newline
+	s.value = strings.TrimRight(string(data), "\r\n")
+	return s.value, nil
+}
+
+// credentialsProvider returns the username and password on every connection
+// attempt, reading the files when set.
+func credentialsProvider(username, password string, usernameFile, passwordFile *secretFile) mqtt.CredentialsProvider {
+	return func() (string, string) {
+		u, p := username, password
+		if usernameFile != nil {
+			u, _ = usernameFile.read()
+		}
+		if passwordFile != nil {
+			p, _ = passwordFile.read()
+		}
+		return u, p
+	}
+}
@@ -0,0 +1,90 @@
+package extension
+
+// #include <stdlib.h>
+// #include "../sqlite3ext.h"
+//
+// // set by the entry point of the extension
+// extern const sqlite3_api_routines *sqlite3_api;
+//
+// // the virtual table methods exported by github.com/walterwanderley/sqlite
+// extern int x_create_tramp(sqlite3*, void*, int, const char* const*, sqlite3_vtab**, char**);
+// extern int x_connect_tramp(sqlite3*, void*, int, const char* const*, sqlite3_vtab**, char**);
+// extern int x_best_index_tramp(sqlite3_vtab*, sqlite3_index_info*);
+// extern int x_disconnect_tramp(sqlite3_vtab*);
+// extern int x_destroy_tramp(sqlite3_vtab*);
+// extern int x_open_tramp(sqlite3_vtab*, sqlite3_vtab_cursor**);
+// extern int x_close_tramp(sqlite3_vtab_cursor*);
+// extern int x_filter_tramp(sqlite3_vtab_cursor*, int, const char*, int, sqlite3_value**);
+// extern int x_next_tramp(sqlite3_vtab_cursor*);
+// extern int x_eof_tramp(sqlite3_vtab_cursor*);
+// extern int x_column_tramp(sqlite3_vtab_cursor*, sqlite3_context*, int);
+// extern int x_rowid_tramp(sqlite3_vtab_cursor*, sqlite3_int64*);
+// extern int x_update_tramp(sqlite3_vtab*, int, sqlite3_value**, sqlite3_int64*);
+// extern int x_begin_tramp(sqlite3_vtab*);
+// extern int x_sync_tramp(sqlite3_vtab*);
+// extern int x_commit_tramp(sqlite3_vtab*);
+// extern int x_rollback_tramp(sqlite3_vtab*);
+// extern void module_destroy(void*);
+//
+// static int mqtt_sub_shadow_name(const char *suffix) {
+// 	return sqlite3_api->stricmp(suffix, "subscriptions") == 0;
+// }
+//
+// // a writable, transactional module, like the ones of sqlite.ExtensionApi.CreateModule,
+// // with the subscriptions shadow table
+// static sqlite3_module mqtt_sub_module = {
+// 	.iVersion = 3,
+// 	.xCreate = x_create_tramp,
+// 	.xConnect = x_connect_tramp,
+// 	.xBestIndex = x_best_index_tramp,
+// 	.xDisconnect = x_disconnect_tramp,
+// 	.xDestroy = x_destroy_tramp,
+// 	.xOpen = x_open_tramp,
+// 	.xClose = x_close_tramp,
+// 	.xFilter = x_filter_tramp,
+// 	.xNext = x_next_tramp,
+// 	.xEof = x_eof_tramp,
+// 	.xColumn = x_column_tramp,
+// 	.xRowid = x_rowid_tramp,
+// 	.xUpdate = x_update_tramp,
+// 	.xBegin = x_begin_tramp,
+// 	.xSync = x_sync_tramp,
+// 	.xCommit = x_commit_tramp,
+// 	.xRollback = x_rollback_tramp,
+// 	.xShadowName = mqtt_sub_shadow_name,
+// };
+//
+// static int mqtt_create_sub_module(sqlite3 *db, const char *name, void *aux) {
+// 	return sqlite3_api->create_module_v2(db, name, &mqtt_sub_module, aux, module_destroy);
+// }
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/mattn/go-pointer"
+	"github.com/walterwanderley/sqlite"
+)
+
+// subscriptionsShadowSuffix names the shadow table of the mqtt_sub virtual tables,
+// <name>_subscriptions in the schema of the virtual table.
+const subscriptionsShadowSuffix = "subscriptions"
+
+// createSubscriberModule registers the mqtt_sub module. sqlite.ExtensionApi.CreateModule
+// can't declare shadow tables, so the module is registered with the same methods
+// and an xShadowName recognizing the subscriptions table: SQLite then protects it
+// like the shadow tables of FTS5 or R*Tree.
+func createSubscriberModule(api *sqlite.ExtensionApi, name string, module sqlite.StatefulModule) error {
+	db, err := sqliteHandle(api)
+	if err != nil {
+		return fmt.Errorf("creating module %q: %w", name, err)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	aux := pointer.Save(module)
+	if rc := C.mqtt_create_sub_module(db, cname, aux); rc != C.SQLITE_OK {
+		return fmt.Errorf("creating module %q: %w", name, sqlite.ErrorCode(rc))
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package extension
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// sharedClients maps a connection key to the MQTT client shared by every virtual
+// table with the same connection settings, or the same connection option, in the
+// process. The client is disconnected when the last virtual table using it is.
+var (
+	sharedClients   = make(map[string]*sharedClient)
+	sharedClientsMu sync.Mutex
+)
+
+// sharedClient fans the callbacks of one MQTT client out to the virtual tables using it.
+type sharedClient struct {
+	key      string
+	settings string
+	servers  int
+	will     *will
+	client   client
+	// users counts the virtual tables holding a reference, guarded by sharedClientsMu
+	users int
+
+	mu      sync.Mutex
+	refs    []*clientRef
+	started bool
+	// up is set once the connect callbacks were dispatched for the current connection
+	up bool
+	// subs maps each topic filter to the handler of every virtual table subscribed to it
+	subs map[string]map[*clientRef]messageHandler
+}
+
+// clientRef is the client handed to a virtual table, a reference to a sharedClient.
+type clientRef struct {
+	shared           *sharedClient
+	cfg              clientConfig
+	logger           *slog.Logger
+	virtualTableName string
+	// filters are the topic filters the virtual table subscribes, guarded by shared.mu
+	filters map[string]struct{}
+	// unacked holds the messages delivered with manualAck and not acknowledged yet,
+	// guarded by shared.mu. It is nil once the virtual table is disconnected.
+	unacked  map[uint64]func()
+	lastAck  uint64
+	released bool
+}
+
+// acquireClient returns a reference to the client for the connection settings,
+// creating it if no other virtual table uses them.
+func acquireClient(cfg clientConfig, logger *slog.Logger, virtualTableName string) (client, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	key := "settings:" + cfg.settings
+	if cfg.connection != "" {
+		key = "connection:" + cfg.connection
+	}
+
+	sharedClientsMu.Lock()
+	defer sharedClientsMu.Unlock()
+	sc, ok := sharedClients[key]
+	if ok {
+		if cfg.connection != "" && len(cfg.options.Servers) > 0 && cfg.settings != sc.settings {
+			return nil, fmt.Errorf("connection %q is already open with different settings", cfg.connection)
+		}
+	} else {
+		if cfg.connection != "" && len(cfg.options.Servers) == 0 {
+			return nil, fmt.Errorf("connection %q is not open, set the servers option", cfg.connection)
+		}
+		sc = &sharedClient{
+			key:      key,
+			settings: cfg.settings,
+			servers:  len(cfg.options.Servers),
+			will:     cfg.will,
+			subs:     make(map[string]map[*clientRef]messageHandler),
+		}
+		// every virtual table decides when the messages delivered to it are acknowledged
+		clientCfg := cfg
+		clientCfg.manualAck = true
+		clientCfg.defaultHandler = sc.defaultHandler
+		clientCfg.onConnect = sc.onConnect
+		clientCfg.onConnectionLost = sc.onConnectionLost
+		clientCfg.onConnectError = sc.onConnectError
+		c, err := newClient(clientCfg)
+		if err != nil {
+			return nil, err
+		}
+		sc.client = c
+		sharedClients[key] = sc
+	}
+	sc.users++
+
+	ref := clientRef{
+		shared:           sc,
+		cfg:              cfg,
+		logger:           logger,
+		virtualTableName: virtualTableName,
+		filters:          make(map[string]struct{}),
+		unacked:          make(map[uint64]func()),
+	}
+	for _, topic := range cfg.topics {
+		ref.filters[topic] = struct{}{}
+	}
+	return &ref, nil
+}
+
+// Connect connects the shared client on the first call. The other virtual tables
+// join the connection, failing unless it is up or they were created with lazy_connect.
+func (r *clientRef) Connect() error {
+	sc := r.shared
+	sc.mu.Lock()
+	sc.refs = append(sc.refs, r)
+	if !sc.started {
+		sc.started = true
+		sc.mu.Unlock()
+		err := sc.client.Connect()
+		if err != nil {
+			sc.mu.Lock()
+			sc.started = false
+			sc.mu.Unlock()
+		}
+		return err
+	}
+	up := sc.up
+	sc.mu.Unlock()
+	if up {
+		go r.cfg.onConnect()
+		return nil
+	}
+	// a client connected but not up yet is about to dispatch the connect callbacks
+	if sc.servers > 0 && !r.cfg.lazyConnect && !sc.client.IsConnected() {
+		return errNotConnected
+	}
+	return nil
+}
+
+func (r *clientRef) Publish(msg *message) error {
+	return r.shared.client.Publish(msg)
+}
+
+func (r *clientRef) Subscribe(topic string, qos byte, handler messageHandler) error {
+	sc := r.shared
+	sc.mu.Lock()
+	handlers, ok := sc.subs[topic]
+	if !ok {
+		handlers = make(map[*clientRef]messageHandler)
+		sc.subs[topic] = handlers
+	}
+	handlers[r] = handler
+	r.filters[topic] = struct{}{}
+	sc.mu.Unlock()
+
+	err := sc.client.Subscribe(topic, qos, sc.topicHandler(topic))
+	if err != nil {
+		sc.mu.Lock()
+		if handlers, ok := sc.subs[topic]; ok {
+			delete(handlers, r)
+			if len(handlers) == 0 {
+				delete(sc.subs, topic)
+			}
+		}
+		sc.mu.Unlock()
+	}
+	return err
+}
+
+// Unsubscribe unsubscribes from the broker the topics no other virtual table is subscribed to.
+func (r *clientRef) Unsubscribe(topics ...string) error {
+	sc := r.shared
+	sc.mu.Lock()
+	var unused []string
+	for _, topic := range topics {
+		delete(r.filters, topic)
+		handlers, ok := sc.subs[topic]
+		if !ok {
+			unused = append(unused, topic)
+			continue
+		}
+		delete(handlers, r)
+		if len(handlers) == 0 {
+			delete(sc.subs, topic)
+			unused = append(unused, topic)
+		}
+	}
+	sc.mu.Unlock()
+	if len(unused) == 0 {
+		return nil
+	}
+	return sc.client.Unsubscribe(unused...)
+}
+
+// Disconnect releases the reference, disconnecting the client if it was the last one.
+// The messages the virtual table did not acknowledge are acknowledged on its behalf
+// while other virtual tables use the client, which would otherwise never acknowledge
+// them to the broker. A client disconnected leaves them to be redelivered.
+func (r *clientRef) Disconnect() {
+	sc := r.shared
+	sc.mu.Lock()
+	sc.refs = slices.DeleteFunc(sc.refs, func(ref *clientRef) bool {
+		return ref == r
+	})
+	for topic, handlers := range sc.subs {
+		delete(handlers, r)
+		if len(handlers) == 0 {
+			delete(sc.subs, topic)
+		}
+	}
+	unacked := r.unacked
+	r.unacked = nil
+	sc.mu.Unlock()
+
+	sharedClientsMu.Lock()
+	if r.released {
+		sharedClientsMu.Unlock()
+		return
+	}
+	r.released = true
+	sc.users--
+	last := sc.users == 0
+	if last {
+		delete(sharedClients, sc.key)
+	}
+	sharedClientsMu.Unlock()
+	if last {
+		sc.client.Disconnect()
+		return
+	}
+	for _, done := range unacked {
+		done()
+	}
+}
+
+func (r *clientRef) ClientID() string {
+	return r.shared.client.ClientID()
+}
+
+func (r *clientRef) IsConnected() bool {
+	return r.shared.client.IsConnected()
+}
+
+func (r *clientRef) ServerURL() string {
+	return r.shared.client.ServerURL()
+}
+
+func (r *clientRef) Certificate() *x509.Certificate {
+	return r.shared.client.Certificate()
+}
+
+func (sc *sharedClient) connectedRefs() []*clientRef {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return slices.Clone(sc.refs)
+}
+
+// setUp records the state of the connection, returning the virtual tables to notify.
+func (sc *sharedClient) setUp(up bool) []*clientRef {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.up = up
+	return slices.Clone(sc.refs)
+}
+
+func (sc *sharedClient) onConnect() {
+	refs := sc.setUp(true)
+	if len(refs) == 0 {
+		return
+	}
+	// the birth message is published once per connection, not once per virtual table
+	publishBirth(sc.client, sc.will, refs[0].logger, refs[0].virtualTableName)
+	for _, r := range refs {
+		r.cfg.onConnect()
+	}
+}
+
+func (sc *sharedClient) onConnectionLost(err error) {
+	for _, r := range sc.setUp(false) {
+		r.cfg.onConnectionLost(err)
+	}
+}
+
+func (sc *sharedClient) onConnectError(err error) {
+	for _, r := range sc.connectedRefs() {
+		if r.cfg.onConnectError != nil {
+			r.cfg.onConnectError(err)
+		}
+	}
+}
+
+type delivery struct {
+	ref     *clientRef
+	handler messageHandler
+}
+
+// topicHandler delivers the messages of a subscription to every virtual table subscribed to it.
+func (sc *sharedClient) topicHandler(topic string) messageHandler {
+	return func(msg *message) {
+		sc.mu.Lock()
+		targets := make([]delivery, 0, len(sc.subs[topic]))
+		for r, handler := range sc.subs[topic] {
+			targets = append(targets, delivery{ref: r, handler: handler})
+		}
+		sc.mu.Unlock()
+		deliver(msg, targets)
+	}
+}
+
+// defaultHandler delivers the messages matching no subscription, like the ones a
+// persistent session sends before the topics are subscribed again, to the virtual
+// tables with a matching topic filter. The other messages are dropped.
+func (sc *sharedClient) defaultHandler(msg *message) {
+	sc.mu.Lock()
+	var targets []delivery
+	for _, r := range sc.refs {
+		if r.cfg.defaultHandler == nil {
+			continue
+		}
+		for filter := range r.filters {
+			if topicMatches(filter, msg.topic) {
+				targets = append(targets, delivery{ref: r, handler: r.cfg.defaultHandler})
+				break
+			}
+		}
+	}
+	sc.mu.Unlock()
+	deliver(msg, targets)
+}
+
+// deliver hands a copy of the message to every target. The broker is acknowledged
+// once all of them acknowledged it: when the handler returns, or when the virtual
+// table calls ack if it was created with manualAck.
+func deliver(msg *message, targets []delivery) {
+	ack := msg.ack
+	if ack == nil {
+		ack = func() {}
+	}
+	if len(targets) == 0 {
+		ack()
+		return
+	}
+	var pending atomic.Int32
+	pending.Store(int32(len(targets)))
+	done := func() {
+		if pending.Add(-1) == 0 {
+			ack()
+		}
+	}
+	for _, t := range targets {
+		m := *msg
+		m.ack = nil
+		if t.ref.cfg.manualAck {
+			m.ack = t.ref.track(done)
+			t.handler(&m)
+			continue
+		}
+		t.handler(&m)
+		done()
+	}
+}
+
+// track records a message delivered to the virtual table, returning its
+// acknowledgement: done is called once, by the virtual table or by Disconnect.
+func (r *clientRef) track(done func()) func() {
+	sc := r.shared
+	sc.mu.Lock()
+	if r.unacked == nil {
+		sc.mu.Unlock()
+		done()
+		return func() {}
+	}
+	r.lastAck++
+	id := r.lastAck
+	r.unacked[id] = done
+	sc.mu.Unlock()
+	return func() {
+		sc.mu.Lock()
+		done, ok := r.unacked[id]
+		delete(r.unacked, id)
+		sc.mu.Unlock()
+		if ok {
+			done()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package extension_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clients counts the clients connected to the broker, without its inline client.
+func clients(s *broker) int {
+	return s.Clients.Len() - 1
+}
+
+func TestSharedClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// first opens the client, the other virtual tables use others
+		first, others string
+	}{
+		{
+			name:   "same settings",
+			first:  "servers='tcp://{addr}', client_id=fanout",
+			others: "servers='tcp://{addr}', client_id=fanout",
+		},
+		{
+			name:   "connection option",
+			first:  "servers='tcp://{addr}', client_id=fanout, connection=fanout",
+			others: "connection=fanout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newBroker(t)
+			conn := openDB(t, "")
+			opts := strings.NewReplacer("{addr}", addr)
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.pub USING mqtt_pub("+opts.Replace(tt.first)+")")
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.sub1 USING mqtt_sub("+opts.Replace(tt.others)+", table=data1)")
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.sub2 USING mqtt_sub("+opts.Replace(tt.others)+", table=data2)")
+			// subscribing while connected returns once the broker acknowledged it
+			mustExec(t, conn, "INSERT INTO temp.sub1 VALUES('fan/#', 1)")
+			mustExec(t, conn, "INSERT INTO temp.sub2 VALUES('fan/#', 1)")
+			if n := clients(s); n != 1 {
+				t.Errorf("%d clients connected, want 1", n)
+			}
+			if n := queryInt(t, conn, "SELECT count(DISTINCT client_id) FROM mqtt_connections"); n != 1 {
+				t.Errorf("mqtt_connections lists %d clients, want 1", n)
+			}
+
+			// every subscriber gets its copy of the message
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('fan/1', 'one')")
+			waitFor(t, "fan-out", func() bool {
+				return queryInt(t, conn, "SELECT count(*) FROM data1") == 1 && queryInt(t, conn, "SELECT count(*) FROM data2") == 1
+			})
+
+			// the client stays connected while a virtual table uses it
+			mustExec(t, conn, "DROP TABLE temp.sub1")
+			mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('fan/1', 'two')")
+			waitFor(t, "delivery after DROP", func() bool {
+				return queryInt(t, conn, "SELECT count(*) FROM data2") == 2
+			})
+			if n := queryInt(t, conn, "SELECT count(*) FROM data1"); n != 1 {
+				t.Errorf("dropped subscriber stored %d messages, want 1", n)
+			}
+			if n := clients(s); n != 1 {
+				t.Errorf("%d clients connected, want 1", n)
+			}
+
+			// and is disconnected with the last one
+			mustExec(t, conn, "DROP TABLE temp.sub2")
+			mustExec(t, conn, "DROP TABLE temp.pub")
+			waitFor(t, "disconnection", func() bool { return clients(s) == 0 })
+		})
+	}
+}
+
+func TestSharedClientReleaseAcks(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+	}{
+		{name: "mqtt3", version: "4"},
+		{name: "mqtt5", version: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newBroker(t)
+			conn := openDB(t, filepath.Join(t.TempDir(), "acks.db"))
+			settings := "servers='tcp://" + addr + "', client_id=acker, protocol_version=" + tt.version
+			// the messages rejected by the table are never acknowledged by sub1
+			mustExec(t, conn, "CREATE TABLE data1(client_id TEXT, message_id INTEGER, topic TEXT, payload BLOB CHECK(payload <> 'bad'), qos INTEGER, retained INTEGER, timestamp DATETIME)")
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.sub1 USING mqtt_sub("+settings+", table=data1, ack=after_commit)")
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.sub2 USING mqtt_sub("+settings+", table=data2)")
+			mustExec(t, conn, "INSERT INTO temp.sub1 VALUES('ack/#', 1)")
+			mustExec(t, conn, "INSERT INTO temp.sub2 VALUES('ack/#', 1)")
+
+			if err := s.Publish("ack/1", []byte("bad"), false, 1); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "delivery", func() bool {
+				return queryInt(t, conn, "SELECT count(*) FROM data2") == 1
+			})
+			inflight := func() int {
+				cl, ok := s.Clients.Get("acker")
+				if !ok {
+					t.Fatal("client acker not found")
+				}
+				return cl.State.Inflight.Len()
+			}
+			if n := inflight(); n != 1 {
+				t.Fatalf("%d messages not acknowledged, want 1", n)
+			}
+
+			// releasing sub1 acknowledges its messages, the client stays connected for sub2
+			mustExec(t, conn, "DROP TABLE temp.sub1")
+			waitFor(t, "acknowledgement", func() bool { return inflight() == 0 })
+		})
+	}
+}
+
+func TestSharedClientSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+	}{
+		{name: "outbox", options: ", outbox_table=outbox"},
+		{name: "lazy connect", options: ", lazy_connect=true"},
+		{name: "will", options: ", will_topic=gone"},
+		{name: "logger", options: ", logger=stderr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := newBroker(t)
+			conn := openDB(t, filepath.Join(t.TempDir(), "settings.db"))
+			settings := "servers='tcp://" + addr + "', client_id=settings, connection=settings"
+			mustExec(t, conn, "CREATE VIRTUAL TABLE temp.pub1 USING mqtt_pub("+settings+")")
+			_, err := conn.ExecContext(context.Background(), "CREATE VIRTUAL TABLE pub2 USING mqtt_pub("+settings+tt.options+")")
+			if want := `connection "settings" is already open with different settings`; err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
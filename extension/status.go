@@ -0,0 +1,112 @@
+package extension
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/walterwanderley/sqlite"
+)
+
+const (
+	stateConnecting   = "connecting"
+	stateConnected    = "connected"
+	stateDisconnected = "disconnected"
+)
+
+// connStatus tracks the connection of a virtual table to the broker.
+type connStatus struct {
+	mu             sync.Mutex
+	connected      bool
+	everConnected  bool
+	connectedSince time.Time
+	reconnects     int
+	lastErr        error
+	lastErrTime    time.Time
+}
+
+func (s *connStatus) up() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.everConnected {
+		s.reconnects++
+	}
+	s.connected = true
+	s.everConnected = true
+	s.connectedSince = time.Now()
+}
+
+func (s *connStatus) down(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	if err != nil {
+		s.lastErr = err
+		s.lastErrTime = time.Now()
+	}
+}
+
+// state is connecting until the first connection, then connected or disconnected.
+func (s *connStatus) state() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.connected:
+		return stateConnected
+	case s.everConnected:
+		return stateDisconnected
+	default:
+		return stateConnecting
+	}
+}
+
+// connSnapshot is a copy of a connStatus, safe to read without the lock.
+type connSnapshot struct {
+	connected      bool
+	connectedSince time.Time
+	reconnects     int
+	lastErr        error
+	lastErrTime    time.Time
+}
+
+func (s *connStatus) snapshot() connSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return connSnapshot{
+		connected:      s.connected,
+		connectedSince: s.connectedSince,
+		reconnects:     s.reconnects,
+		lastErr:        s.lastErr,
+		lastErrTime:    s.lastErrTime,
+	}
+}
+
+// Status implements mqtt_status(connection), returning the state of the connection
+// of a publisher or subscriber virtual table on the calling database connection:
+// connecting, connected or disconnected.
+type Status struct {
+	// conn identifies the database connection the function is registered on
+	conn uint64
+}
+
+func (m *Status) Args() int {
+	return 1
+}
+
+func (m *Status) Deterministic() bool {
+	return false
+}
+
+func (m *Status) Apply(ctx *sqlite.Context, values ...sqlite.Value) {
+	name := values[0].Text()
+	pub, pubID, pubOK := publishers.lookup(m.conn, name)
+	sub, subID, subOK := subscribers.lookup(m.conn, name)
+	switch {
+	case pubOK && (!subOK || compareSchemas(pubID.schema, subID.schema) <= 0):
+		ctx.ResultText(pub.status.state())
+	case subOK:
+		ctx.ResultText(sub.status.state())
+	default:
+		ctx.ResultError(fmt.Errorf("virtual table %q not found", name))
+	}
+}
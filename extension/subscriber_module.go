@@ -1,17 +1,13 @@
 package extension
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"net/url"
-	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/walterwanderley/sqlite"
 
 	"github.com/litesql/mqtt/config"
@@ -20,123 +16,93 @@ import (
 var tableNameValid = regexp.MustCompilePOSIX("^[a-zA-Z_][a-zA-Z0-9_.]*$").MatchString
 
 type SubscriberModule struct {
+	// conn identifies the database connection the module is registered on
+	conn uint64
+}
+
+// Create creates the shadow table storing the subscriptions of the virtual table,
+// starting with the ones of the topics option, so that they are restored on the
+// next Connect.
+func (m *SubscriberModule) Create(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	return m.connect(conn, args, declare, true)
 }
 
 func (m *SubscriberModule) Connect(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	return m.connect(conn, args, declare, false)
+}
+
+func (m *SubscriberModule) connect(conn *sqlite.Conn, args []string, declare func(string) error, create bool) (sqlite.VirtualTable, error) {
 	virtualTableName := args[2]
 	if virtualTableName == "" {
 		virtualTableName = config.DefaultSubscriberVTabName
 	}
 
-	var (
-		clientOptions = mqtt.NewClientOptions()
-
-		certFilePath    string
-		certKeyFilePath string
-		caFilePath      string
-		insecure        bool
-
-		tableName string
-		logger    string
-		err       error
-	)
-	if len(args) > 3 {
-		for _, opt := range args[3:] {
-			k, v, ok := strings.Cut(opt, "=")
-			if !ok {
-				return nil, fmt.Errorf("invalid option: %q", opt)
-			}
-			k = strings.TrimSpace(k)
-			v = sanitizeOptionValue(v)
-
-			switch strings.ToLower(k) {
-			case config.ClientID:
-				clientOptions.ClientID = v
-			case config.Timeout:
-				i, err := strconv.Atoi(v)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %w", k, err)
-				}
-				timeout := time.Duration(i) * time.Millisecond
-				clientOptions.PingTimeout = timeout
-				clientOptions.WriteTimeout = timeout
-			case config.KeepAlive:
-				i, err := strconv.ParseInt(v, 10, 64)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %w", k, err)
-				}
-				clientOptions.KeepAlive = i
-			case config.Servers:
-				serverList := strings.Split(v, ",")
-				for _, server := range serverList {
-					server = strings.TrimSpace(server)
-					u, err := url.Parse(server)
-					if err != nil {
-						return nil, fmt.Errorf("invalid %q option: %w", k, err)
-					}
-					clientOptions.Servers = append(clientOptions.Servers, u)
-				}
-			case config.Username:
-				clientOptions.Username = v
-			case config.Password:
-				clientOptions.Password = v
-			case config.CertFile:
-				certFilePath = v
-			case config.CertKeyFile:
-				certKeyFilePath = v
-			case config.CertCAFile:
-				caFilePath = v
-			case config.Insecure:
-				insecure, err = strconv.ParseBool(v)
-				if err != nil {
-					return nil, fmt.Errorf("invalid %q option: %v", k, err)
-				}
-			case config.Storage:
-				if v != "" {
-					clientOptions.SetStore(mqtt.NewFileStore(v))
-				}
-			case config.TableName:
-				tableName = v
-			case config.Logger:
-				logger = v
-			default:
-				return nil, fmt.Errorf("unknown option: %s", k)
-			}
-		}
+	opts, err := resolveOptions(conn, args[3:])
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseOptions(config.DefaultSubscriberVTabName, opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newClientConfig(values)
+	if err != nil {
+		return nil, err
 	}
 
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: insecure,
+	tableName := values.get(config.TableName)
+	if !tableNameValid(tableName) {
+		return nil, fmt.Errorf("table name %q is invalid", tableName)
 	}
+	metadata := values.boolean(config.Metadata)
 
-	if certFilePath != "" && certKeyFilePath != "" {
-		clientCert, err := tls.LoadX509KeyPair(certFilePath, certKeyFilePath)
+	var topics []subscription
+	if values.has(config.Topics) {
+		topics, err = parseTopics(values.get(config.Topics))
 		if err != nil {
-			return nil, fmt.Errorf("error loading client certificate: %w", err)
+			return nil, fmt.Errorf("invalid %q option: %w", config.Topics, err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{clientCert}
 	}
-
-	if caFilePath != "" {
-		caCertPEM, err := os.ReadFile(caFilePath)
-		if err != nil {
-			return nil, fmt.Errorf("error loading CA certificate: %w", err)
+	// on Connect the topics are restored from the table, where they may have been deleted
+	subscriptionsTable := fmt.Sprintf("%s.%s_%s", args[1], virtualTableName, subscriptionsShadowSuffix)
+	if create {
+		if err := createSubscriptionsTable(conn, subscriptionsTable, topics); err != nil {
+			return nil, err
 		}
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCertPEM) {
-			return nil, fmt.Errorf("error appending CA certificate to pool")
+	}
+
+	batchSize := values.integer(config.BatchSize)
+	batchInterval := time.Duration(values.integer(config.BatchInterval)) * time.Millisecond
+	queueSize := values.integer(config.QueueSize)
+	for _, name := range []string{config.BatchSize, config.BatchInterval, config.QueueSize} {
+		if values.integer(name) < 0 {
+			return nil, fmt.Errorf("invalid %q option: must be a positive number", name)
 		}
-		tlsConfig.RootCAs = caCertPool
 	}
 
-	clientOptions = clientOptions.SetTLSConfig(&tlsConfig)
+	overflow, err := parseOverflowPolicy(values.get(config.Overflow))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q option: %w", config.Overflow, err)
+	}
+	if values.has(config.Overflow) && queueSize == 0 {
+		return nil, fmt.Errorf("%q requires %q", config.Overflow, config.QueueSize)
+	}
 
-	if tableName == "" {
-		tableName = config.DefaultTableName
+	ack, err := parseAckMode(values.get(config.Ack))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q option: %w", config.Ack, err)
 	}
 
-	if !tableNameValid(tableName) {
-		return nil, fmt.Errorf("table name %q is invalid", tableName)
+	var metadataColumns string
+	if metadata {
+		metadataColumns = `,
+		properties TEXT,
+		content_type TEXT,
+		response_topic TEXT,
+		correlation_data BLOB,
+		message_expiry_interval INTEGER,
+		subscription_identifier INTEGER,
+		dup INTEGER`
 	}
 
 	err = conn.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
@@ -146,15 +112,96 @@ func (m *SubscriberModule) Connect(conn *sqlite.Conn, args []string, declare fun
 		payload BLOB,
 		qos INTEGER,
 		retained INTEGER,
-		timestamp DATETIME
-	)`, tableName), nil)
+		timestamp DATETIME%s
+	)`, tableName, metadataColumns), nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating %q table: %w", tableName, err)
 	}
 
-	vtab, err := NewSubscriberVirtualTable(virtualTableName, clientOptions, tableName, conn, logger)
+	ackAfterCommit := ack == ackAfterCommit
+	cfg.manualAck = ackAfterCommit
+	// messages acknowledged after commit always go through the batch, committed
+	// by a connection of its own
+	if ackAfterCommit && batchSize == 0 && batchInterval == 0 {
+		batchSize = 1
+	}
+
+	subCfg := subscriberConfig{
+		tableName:          tableName,
+		metadata:           metadata,
+		subscriptionsTable: subscriptionsTable,
+		batchSize:          batchSize,
+		batchInterval:      batchInterval,
+		queueSize:          queueSize,
+		overflow:           overflow,
+		spillDir:           cfg.storage,
+		ackAfterCommit:     ackAfterCommit,
+	}
+
+	vtab, err := NewSubscriberVirtualTable(virtualTableName, cfg, subCfg, conn, values.get(config.Logger))
 	if err != nil {
 		return nil, err
 	}
+	subscribers.add(vtab, tableID{conn: m.conn, schema: args[1], name: virtualTableName})
 	return vtab, declare("CREATE TABLE x(topic TEXT PRIMARY KEY, qos INTEGER)")
 }
+
+const (
+	ackAuto        = "auto"
+	ackAfterCommit = "after_commit"
+)
+
+func parseAckMode(v string) (string, error) {
+	switch v {
+	case ackAuto, ackAfterCommit:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported mode %q, use %s or %s", v, ackAuto, ackAfterCommit)
+	}
+}
+
+// parseTopics parses a comma-separated list of topic filters, each one optionally
+// followed by :qos, for example "sensors/+/temp:1,alarms/#:2".
+func parseTopics(v string) ([]subscription, error) {
+	var topics []subscription
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		topic, qos := item, 0
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid QoS for %q: %w", item[:i], err)
+			}
+			topic, qos = strings.TrimSpace(item[:i]), n
+		}
+		if topic == "" {
+			return nil, fmt.Errorf("topic is invalid")
+		}
+		if qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("QoS must be the number 0, 1 or 2")
+		}
+		if slices.ContainsFunc(topics, func(s subscription) bool { return s.topic == topic }) {
+			return nil, fmt.Errorf("topic %q is repeated", topic)
+		}
+		topics = append(topics, subscription{topic: topic, qos: byte(qos)})
+	}
+	return topics, nil
+}
+
+// createSubscriptionsTable creates the table of the subscriptions, starting with the topics.
+func createSubscriptionsTable(conn *sqlite.Conn, table string, topics []subscription) error {
+	err := conn.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s(topic TEXT PRIMARY KEY, qos INTEGER)", table), nil)
+	if err != nil {
+		return fmt.Errorf("creating %q table: %w", table, err)
+	}
+	for _, topic := range topics {
+		err := conn.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s(topic, qos) VALUES(?, ?)", table), nil, topic.topic, topic.qos)
+		if err != nil {
+			return fmt.Errorf("saving subscription: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package extension
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTopics(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []subscription
+		wantErr string
+	}{
+		{value: "a/b", want: []subscription{{topic: "a/b"}}},
+		{value: "sensors/+/temp:1, alarms/#:2", want: []subscription{{topic: "sensors/+/temp", qos: 1}, {topic: "alarms/#", qos: 2}}},
+		{value: "$share/group/a/#:1", want: []subscription{{topic: "$share/group/a/#", qos: 1}}},
+		{value: "a,,b:0,", want: []subscription{{topic: "a"}, {topic: "b"}}},
+		{value: "", want: nil},
+		{value: "a:x", wantErr: `invalid QoS for "a": strconv.Atoi: parsing "x": invalid syntax`},
+		{value: "a:3", wantErr: "QoS must be the number 0, 1 or 2"},
+		{value: ":1", wantErr: "topic is invalid"},
+		{value: "a:1,a:2", wantErr: `topic "a" is repeated`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseTopics(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAckMode(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{value: "auto"},
+		{value: "after_commit"},
+		{value: "AUTO", wantErr: `unsupported mode "AUTO", use auto or after_commit`},
+		{value: "manual", wantErr: `unsupported mode "manual", use auto or after_commit`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAckMode(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.value {
+				t.Errorf("got %q, %v, want %q", got, err, tt.value)
+			}
+		})
+	}
+}
@@ -1,71 +1,186 @@
 package extension
 
 import (
-	"cmp"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"runtime"
 	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/walterwanderley/sqlite"
 )
 
 type SubscriberVirtualTable struct {
 	virtualTableName string
 	tableName        string
-	client           mqtt.Client
-	subscriptions    []subscription
-	stmt             *sqlite.Stmt
-	stmtMu           sync.Mutex
-	mu               sync.Mutex
-	logger           *slog.Logger
-	loggerCloser     io.Closer
+	metadata         bool
+	client           client
+	conn             *sqlite.Conn
+	// persistentSession is true with clean_session=false
+	persistentSession bool
+	// subscriptions are the committed subscriptions, the ones sent to the broker
+	subscriptions []subscription
+	// subscriptionsTable is the shadow table holding the subscriptions, changed
+	// by INSERT and DELETE and applied to the broker when the transaction commits
+	subscriptionsTable string
+	// synced holds the subscriptions read from the table by Sync, applied by
+	// Commit, and subscribed the ones Sync sent to the broker, undone by Rollback
+	synced       []subscription
+	subscribed   []subscription
+	inSync       bool
+	mu           sync.Mutex
+	logger       *slog.Logger
+	loggerCloser io.Closer
+	status       connStatus
+
+	// stmt inserts the messages through the connection of the application,
+	// locked by connLock while the writer uses it
+	stmt     *sqlite.Stmt
+	connLock connLock
+
+	// with batchSize > 0 incoming messages wait in batch and are written
+	// in a single transaction when it is full or every batchInterval, through
+	// db, a connection of their own, so that they never join the transactions
+	// of the application
+	batchSize int
+	// ackAfterCommit acknowledges the messages only after the batch is committed
+	ackAfterCommit bool
+	db             *dbConn
+	insertQuery    string
+	batchStmt      *sqlite.Stmt
+	stmtMu         sync.Mutex
+	batch          []*message
+	batchMu        sync.Mutex
+	batchDone      chan struct{}
+	batchWg        sync.WaitGroup
+
+	// the MQTT client callbacks hand the messages to a dedicated writer through
+	// queue, unbounded without queue_size, so that they never wait for the database
+	queue    *messageQueue
+	writerWg sync.WaitGroup
+	// closing stops the writer from waiting for the connection of the
+	// application, leftover is the message it gave up on
+	closing  atomic.Bool
+	leftover *message
 }
 
+// subscribers holds the connected subscriber virtual tables, so that
+// mqtt_queue_stats can report on the one named on the calling connection.
+var subscribers tableRegistry[*SubscriberVirtualTable]
+
+// subscriberConfig holds the mqtt_sub options that are not related to the client connection.
+type subscriberConfig struct {
+	tableName          string
+	metadata           bool
+	subscriptionsTable string
+	batchSize          int
+	batchInterval      time.Duration
+	queueSize          int
+	overflow           string
+	spillDir           string
+	ackAfterCommit     bool
+}
+
+// defaultBatchInterval is used when only batch_size is set.
+const defaultBatchInterval = time.Second
+
+// connLockRetryInterval is how long the writer waits for the statement running
+// on the connection of the application before trying to lock it again.
+const connLockRetryInterval = time.Millisecond
+
 type subscription struct {
 	topic string
 	qos   byte
 }
 
-func NewSubscriberVirtualTable(virtualTableName string, clientOptions *mqtt.ClientOptions, tableName string, conn *sqlite.Conn, loggerDef string) (*SubscriberVirtualTable, error) {
-
-	stmt, _, err := conn.Prepare(fmt.Sprintf(`INSERT INTO %s(client_id, message_id, topic, payload, qos, retained, timestamp) VALUES(?, ?, ?, ?, ?, ?, ?)`, tableName))
+func NewSubscriberVirtualTable(virtualTableName string, cfg clientConfig, subCfg subscriberConfig, conn *sqlite.Conn, loggerDef string) (*SubscriberVirtualTable, error) {
+	query := fmt.Sprintf(`INSERT INTO %s(client_id, message_id, topic, payload, qos, retained, timestamp) VALUES(?, ?, ?, ?, ?, ?, ?)`, subCfg.tableName)
+	if subCfg.metadata {
+		query = fmt.Sprintf(`INSERT INTO %s(client_id, message_id, topic, payload, qos, retained, timestamp, properties, content_type, response_topic, correlation_data, message_expiry_interval, subscription_identifier, dup) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, subCfg.tableName)
+	}
+	lock, err := newConnLock(conn)
+	if err != nil {
+		return nil, err
+	}
+	stmt, _, err := conn.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 
 	vtab := SubscriberVirtualTable{
-		virtualTableName: virtualTableName,
-		tableName:        tableName,
-		subscriptions:    make([]subscription, 0),
-		stmt:             stmt,
+		virtualTableName:   virtualTableName,
+		tableName:          subCfg.tableName,
+		metadata:           subCfg.metadata,
+		conn:               conn,
+		persistentSession:  !cfg.options.CleanSession,
+		subscriptions:      make([]subscription, 0),
+		subscriptionsTable: subCfg.subscriptionsTable,
+		stmt:               stmt,
+		connLock:           lock,
+		batchSize:          subCfg.batchSize,
+		ackAfterCommit:     subCfg.ackAfterCommit,
+		insertQuery:        query,
+	}
+
+	if subCfg.batchSize > 0 || subCfg.batchInterval > 0 {
+		schema, _ := splitTableName(subCfg.tableName)
+		db, err := openDBConn(conn, schema)
+		if err != nil {
+			err = fmt.Errorf("batch_size, batch_interval and ack=%s write the %q table through a connection of their own: %w", ackAfterCommit, subCfg.tableName, err)
+			return nil, errors.Join(err, stmt.Finalize())
+		}
+		vtab.db = db
+	}
+
+	// the subscriptions are sent to the broker by onConnectHandler
+	if err := vtab.loadSubscriptions(); err != nil {
+		return nil, errors.Join(err, vtab.closeStatements())
 	}
 
 	logger, loggerCloser, err := loggerFromConfig(loggerDef)
 	if err != nil {
-		return nil, err
+		return nil, errors.Join(err, vtab.closeStatements())
 	}
 	vtab.loggerCloser = loggerCloser
 	vtab.logger = logger
 
-	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetConnectionLostHandler(vtab.onConnectionLost)
-	clientOptions.SetOnConnectHandler(vtab.onConnectHandler)
+	cfg.onConnect = vtab.onConnectHandler
+	cfg.onConnectionLost = vtab.onConnectionLost
+	cfg.onConnectError = vtab.status.down
+	cfg.defaultHandler = vtab.messageHandler
+	for _, subscription := range vtab.subscriptions {
+		cfg.topics = append(cfg.topics, subscription.topic)
+	}
 
-	client := mqtt.NewClient(clientOptions)
+	client, err := acquireClient(cfg, logger, virtualTableName)
+	if err != nil {
+		return nil, errors.Join(err, vtab.closeStatements())
+	}
+	vtab.client = client
 
-	if len(clientOptions.Servers) != 0 {
-		tok := client.Connect()
-		if tok.Wait() && tok.Error() != nil {
-			return nil, fmt.Errorf("connecting to mqtt server: %w", tok.Error())
+	if vtab.db != nil {
+		interval := subCfg.batchInterval
+		if interval == 0 {
+			interval = defaultBatchInterval
 		}
+		vtab.batchDone = make(chan struct{})
+		vtab.batchWg.Add(1)
+		go vtab.flushEvery(interval)
 	}
 
-	vtab.client = client
+	vtab.queue = newMessageQueue(subCfg.queueSize, subCfg.overflow, subCfg.spillDir, logger)
+	vtab.writerWg.Add(1)
+	go vtab.writer()
+
+	if err := connect(client, cfg, logger, virtualTableName); err != nil {
+		client.Disconnect()
+		return nil, errors.Join(err, vtab.drain(), vtab.closeStatements())
+	}
 
 	return &vtab, nil
 }
@@ -75,32 +190,105 @@ func (vt *SubscriberVirtualTable) BestIndex(in *sqlite.IndexInfoInput) (*sqlite.
 }
 
 func (vt *SubscriberVirtualTable) Open() (sqlite.VirtualCursor, error) {
-	return newSubscriptionsCursor(vt.subscriptions), nil
+	var data []subscriptionRow
+	err := vt.conn.Exec(fmt.Sprintf("SELECT rowid, topic, qos FROM %s ORDER BY topic", vt.subscriptionsTable), func(stmt *sqlite.Stmt) error {
+		data = append(data, subscriptionRow{
+			rowid:        stmt.ColumnInt64(0),
+			subscription: subscription{topic: stmt.ColumnText(1), qos: byte(stmt.ColumnInt(2))},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %q table: %w", vt.subscriptionsTable, err)
+	}
+	return &subscriptionsCursor{data: data}, nil
 }
 
+// Disconnect releases the client. A persistent session keeps the subscriptions
+// on the broker, which queues the messages until the virtual table connects again.
 func (vt *SubscriberVirtualTable) Disconnect() error {
-	var err error
+	return vt.close(!vt.persistentSession)
+}
+
+func (vt *SubscriberVirtualTable) Destroy() error {
+	err := vt.conn.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", vt.subscriptionsTable), nil)
+	return errors.Join(err, vt.close(true))
+}
+
+func (vt *SubscriberVirtualTable) close(unsubscribe bool) error {
+	subscribers.remove(vt)
+	// the messages are written, and the queue closed, before unsubscribing: the
+	// MQTT client waits for the acknowledgement of the unsubscription while it
+	// delivers the messages, which are now dropped without being acknowledged
+	err := vt.drain()
+	if unsubscribe {
+		err = errors.Join(err, vt.unsubscribeAll())
+	}
+	vt.client.Disconnect()
+
+	err = errors.Join(err, vt.closeStatements())
 	if vt.loggerCloser != nil {
-		err = vt.loggerCloser.Close()
+		err = errors.Join(err, vt.loggerCloser.Close())
 	}
-	if size := len(vt.subscriptions); size > 0 {
-		topics := make([]string, 0)
-		for _, subscription := range vt.subscriptions {
-			topics = append(topics, subscription.topic)
-		}
-		tok := vt.client.Unsubscribe(topics...)
-		tok.Wait()
-		err = errors.Join(err, tok.Error())
+	return err
+}
+
+func (vt *SubscriberVirtualTable) closeStatements() error {
+	err := vt.stmt.Finalize()
+	if vt.batchStmt != nil {
+		err = errors.Join(err, vt.batchStmt.Finalize())
+	}
+	if vt.db != nil {
+		err = errors.Join(err, vt.db.close())
+	}
+	return err
+}
+
+func (vt *SubscriberVirtualTable) unsubscribeAll() error {
+	if len(vt.subscriptions) == 0 || !vt.client.IsConnected() {
+		return nil
+	}
+	topics := make([]string, 0, len(vt.subscriptions))
+	for _, subscription := range vt.subscriptions {
+		topics = append(topics, subscription.topic)
 	}
-	vt.client.Disconnect(200)
+	return vt.client.Unsubscribe(topics...)
+}
 
-	return errors.Join(err, vt.stmt.Finalize())
+// loadSubscriptions reads the subscriptions stored by the previous connections.
+func (vt *SubscriberVirtualTable) loadSubscriptions() error {
+	schema, name, _ := strings.Cut(vt.subscriptionsTable, ".")
+	var exists bool
+	err := vt.conn.Exec(fmt.Sprintf("SELECT 1 FROM %s.sqlite_master WHERE type = 'table' AND name = ?", schema), func(stmt *sqlite.Stmt) error {
+		exists = true
+		return nil
+	}, name)
+	if err != nil || !exists {
+		return err
+	}
+	vt.subscriptions, err = vt.readSubscriptions()
+	return err
 }
 
-func (vt *SubscriberVirtualTable) Destroy() error {
-	return nil
+// readSubscriptions reads the subscriptions of the table, including the ones
+// changed by the current transaction.
+func (vt *SubscriberVirtualTable) readSubscriptions() ([]subscription, error) {
+	subscriptions := make([]subscription, 0)
+	err := vt.conn.Exec(fmt.Sprintf("SELECT topic, qos FROM %s ORDER BY rowid", vt.subscriptionsTable), func(stmt *sqlite.Stmt) error {
+		subscriptions = append(subscriptions, subscription{
+			topic: stmt.ColumnText(0),
+			qos:   byte(stmt.ColumnInt(1)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %q table: %w", vt.subscriptionsTable, err)
+	}
+	return subscriptions, nil
 }
 
+// Insert stores the subscription in the table, it is sent to the broker when
+// the transaction commits.
 func (vt *SubscriberVirtualTable) Insert(values ...sqlite.Value) (int64, error) {
 	if len(values) < 2 {
 		return 0, fmt.Errorf("inform at least 2 values: Topic and Qos")
@@ -114,18 +302,22 @@ func (vt *SubscriberVirtualTable) Insert(values ...sqlite.Value) (int64, error)
 		return 0, fmt.Errorf("QoS must be the number 0, 1 or 2")
 	}
 
-	vt.mu.Lock()
-	defer vt.mu.Unlock()
-	if vt.contains(topic) {
+	var exists bool
+	err := vt.conn.Exec(fmt.Sprintf("SELECT 1 FROM %s WHERE topic = ?", vt.subscriptionsTable), func(stmt *sqlite.Stmt) error {
+		exists = true
+		return nil
+	}, topic)
+	if err != nil {
+		return 0, fmt.Errorf("reading %q table: %w", vt.subscriptionsTable, err)
+	}
+	if exists {
 		return 0, fmt.Errorf("already subscribed to the %q topic", topic)
 	}
-
-	tok := vt.client.Subscribe(topic, byte(qos), vt.messageHandler)
-	if tok.Wait() && tok.Error() != nil {
-		return 0, fmt.Errorf("subscribe error: %w", tok.Error())
+	err = vt.conn.Exec(fmt.Sprintf("INSERT INTO %s(topic, qos) VALUES(?, ?)", vt.subscriptionsTable), nil, topic, qos)
+	if err != nil {
+		return 0, fmt.Errorf("saving subscription: %w", err)
 	}
-	vt.subscriptions = append(vt.subscriptions, subscription{topic: topic, qos: byte(qos)})
-	return 1, nil
+	return vt.conn.LastInsertRowID(), nil
 }
 
 func (vt *SubscriberVirtualTable) Update(_ sqlite.Value, _ ...sqlite.Value) error {
@@ -136,121 +328,373 @@ func (vt *SubscriberVirtualTable) Replace(old sqlite.Value, new sqlite.Value, _
 	return fmt.Errorf("UPDATE operations on %q are not supported", vt.virtualTableName)
 }
 
+// Delete removes the subscription from the table, it is unsubscribed from the
+// broker when the transaction commits.
 func (vt *SubscriberVirtualTable) Delete(v sqlite.Value) error {
+	err := vt.conn.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid = ?", vt.subscriptionsTable), nil, v.Int64())
+	if err != nil {
+		return fmt.Errorf("removing subscription: %w", err)
+	}
+	return nil
+}
+
+func (vt *SubscriberVirtualTable) Begin() error {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	vt.synced, vt.subscribed, vt.inSync = nil, nil, false
+	return nil
+}
+
+// Sync subscribes to the topics added by the transaction. It fails, rolling back
+// the whole transaction, when the broker refuses one of them.
+func (vt *SubscriberVirtualTable) Sync() error {
+	synced, err := vt.readSubscriptions()
+	if err != nil {
+		return err
+	}
 	vt.mu.Lock()
 	defer vt.mu.Unlock()
-	index := v.Int()
-	// slices are 0 based
-	index--
-
-	if index >= 0 && index < len(vt.subscriptions) {
-		subscription := vt.subscriptions[index]
-		tok := vt.client.Unsubscribe(subscription.topic)
-		if tok.Wait() && tok.Error() != nil {
-			return fmt.Errorf("subscribe from %q: %w", subscription.topic, tok.Error())
+	vt.synced, vt.inSync = synced, true
+	// while disconnected the subscriptions wait for onConnectHandler
+	if !vt.client.IsConnected() {
+		return nil
+	}
+	for _, subscription := range synced {
+		if slices.Contains(vt.subscriptions, subscription) {
+			continue
 		}
-		vt.subscriptions = slices.Delete(vt.subscriptions, index, index+1)
+		if err := vt.client.Subscribe(subscription.topic, subscription.qos, vt.messageHandler); err != nil {
+			return fmt.Errorf("subscribe error: %w", err)
+		}
+		vt.subscribed = append(vt.subscribed, subscription)
 	}
 	return nil
 }
 
-func (vt *SubscriberVirtualTable) contains(topic string) bool {
+// Commit unsubscribes from the topics removed by the transaction.
+func (vt *SubscriberVirtualTable) Commit() error {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	if !vt.inSync {
+		return nil
+	}
+	var removed []string
 	for _, subscription := range vt.subscriptions {
-		if subscription.topic == topic {
-			return true
+		if !slices.ContainsFunc(vt.synced, subscription.sameTopic) {
+			removed = append(removed, subscription.topic)
 		}
 	}
-	return false
+	if len(removed) > 0 && vt.client.IsConnected() {
+		if err := vt.client.Unsubscribe(removed...); err != nil {
+			vt.logger.Error("unsubscribe on commit", "virtual_table", vt.virtualTableName, "topics", removed, "error", err)
+		}
+	}
+	vt.subscriptions = vt.synced
+	vt.synced, vt.subscribed, vt.inSync = nil, nil, false
+	return nil
 }
 
-func (vt *SubscriberVirtualTable) messageHandler(c mqtt.Client, msg mqtt.Message) {
+// Rollback restores the subscriptions Sync changed on the broker.
+func (vt *SubscriberVirtualTable) Rollback() error {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	for _, subscription := range vt.subscribed {
+		var err error
+		if i := slices.IndexFunc(vt.subscriptions, subscription.sameTopic); i >= 0 {
+			// subscribed again with another QoS
+			err = vt.client.Subscribe(subscription.topic, vt.subscriptions[i].qos, vt.messageHandler)
+		} else {
+			err = vt.client.Unsubscribe(subscription.topic)
+		}
+		if err != nil {
+			vt.logger.Error("restore subscription on rollback", "virtual_table", vt.virtualTableName, "topic", subscription.topic, "error", err)
+		}
+	}
+	vt.synced, vt.subscribed, vt.inSync = nil, nil, false
+	return nil
+}
+
+func (vt *SubscriberVirtualTable) messageHandler(msg *message) {
+	vt.queue.push(msg)
+}
+
+// writer stores the queued messages until the queue is closed and drained, or
+// until it gives up waiting for the connection of the application to close.
+func (vt *SubscriberVirtualTable) writer() {
+	defer vt.writerWg.Done()
+	for {
+		msg, ok := vt.queue.pop()
+		if !ok {
+			return
+		}
+		if !vt.store(msg) {
+			vt.leftover = msg
+			return
+		}
+	}
+}
+
+// drain stops the writer and the periodic flush, then writes the messages left
+// in the batch and in the queue through the connection of the application, which
+// Disconnect runs on: the connection of the virtual table would wait for the locks
+// the application may hold. Inside a transaction of the application they may
+// still be rolled back, so they are only acknowledged in autocommit mode.
+func (vt *SubscriberVirtualTable) drain() error {
+	vt.closing.Store(true)
+	vt.queue.close()
+	vt.writerWg.Wait()
+	if vt.batchDone != nil {
+		close(vt.batchDone)
+		vt.batchWg.Wait()
+	}
+
+	rest := vt.batch
+	vt.batch = nil
+	if vt.leftover != nil {
+		rest = append(rest, vt.leftover)
+		vt.leftover = nil
+	}
+	for {
+		msg, ok := vt.queue.pop()
+		if !ok {
+			break
+		}
+		rest = append(rest, msg)
+	}
+	stored := make([]*message, 0, len(rest))
+	for _, msg := range rest {
+		if vt.insert(vt.stmt, msg) {
+			stored = append(stored, msg)
+		}
+	}
+	if vt.conn.AutoCommit() {
+		acknowledge(stored)
+	}
+	return vt.queue.release()
+}
+
+// store adds the message to the batch, or writes it through the connection of
+// the application once no statement runs on it. It returns false, leaving the
+// message unwritten, when the virtual table is closing while the connection is busy.
+func (vt *SubscriberVirtualTable) store(msg *message) bool {
+	if vt.db != nil {
+		vt.batchMu.Lock()
+		vt.batch = append(vt.batch, msg)
+		full := vt.batchSize > 0 && len(vt.batch) >= vt.batchSize
+		vt.batchMu.Unlock()
+		if full {
+			vt.flush()
+		}
+		return true
+	}
+
+	// the mutex of the connection belongs to the thread that locked it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for !vt.connLock.tryLock() {
+		if vt.closing.Load() {
+			return false
+		}
+		time.Sleep(connLockRetryInterval)
+	}
+	defer vt.connLock.unlock()
+	vt.insert(vt.stmt, msg)
+	return true
+}
+
+func (vt *SubscriberVirtualTable) flushEvery(interval time.Duration) {
+	defer vt.batchWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-vt.batchDone:
+			return
+		case <-ticker.C:
+			vt.flush()
+		}
+	}
+}
+
+// flush writes the batched messages in a single transaction. When the database
+// stays locked by the application for longer than dbBusyTimeout, the messages
+// wait for the next flush.
+func (vt *SubscriberVirtualTable) flush() {
+	vt.batchMu.Lock()
+	batch := vt.batch
+	vt.batch = nil
+	vt.batchMu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
 	vt.stmtMu.Lock()
 	defer vt.stmtMu.Unlock()
-	err := vt.stmt.Reset()
+	stored, err := vt.writeBatch(batch)
 	if err != nil {
-		vt.logger.Error("reset statement", "error", err, "topic", msg.Topic(), "message_id", msg.MessageID())
+		vt.logger.Error("write batch", "error", err, "table", vt.tableName, "messages", len(batch))
+		vt.batchMu.Lock()
+		vt.batch = append(batch, vt.batch...)
+		vt.batchMu.Unlock()
 		return
 	}
-	clientOpts := c.OptionsReader()
-	vt.stmt.BindText(1, clientOpts.ClientID())
-	vt.stmt.BindInt64(2, int64(msg.MessageID()))
-	vt.stmt.BindText(3, msg.Topic())
-	vt.stmt.BindText(4, string(msg.Payload()))
-	vt.stmt.BindInt64(5, int64(msg.Qos()))
+	// unacknowledged messages are redelivered by the broker
+	acknowledge(stored)
+}
+
+// writeBatch inserts the messages through the connection of the virtual table,
+// returning the ones stored. The caller must hold stmtMu.
+func (vt *SubscriberVirtualTable) writeBatch(batch []*message) ([]*message, error) {
+	// prepared on first use, as a table created along with the virtual table
+	// is only visible to other connections once committed
+	if vt.batchStmt == nil {
+		stmt, _, err := vt.db.Prepare(vt.insertQuery)
+		if err != nil {
+			return nil, err
+		}
+		vt.batchStmt = stmt
+	}
+	if err := vt.db.Exec("BEGIN IMMEDIATE", nil); err != nil {
+		return nil, err
+	}
+	stored := make([]*message, 0, len(batch))
+	for _, msg := range batch {
+		if vt.insert(vt.batchStmt, msg) {
+			stored = append(stored, msg)
+		}
+	}
+	if err := vt.db.Exec("COMMIT", nil); err != nil {
+		return nil, errors.Join(err, vt.db.Exec("ROLLBACK", nil))
+	}
+	return stored, nil
+}
+
+// insert writes the message to the table with the statement, reporting whether
+// it succeeded.
+func (vt *SubscriberVirtualTable) insert(stmt *sqlite.Stmt, msg *message) bool {
+	err := stmt.Reset()
+	if err != nil {
+		vt.logger.Error("reset statement", "error", err, "topic", msg.topic, "message_id", msg.messageID)
+		return false
+	}
+	clientID := vt.client.ClientID()
+	stmt.BindText(1, clientID)
+	stmt.BindInt64(2, int64(msg.messageID))
+	stmt.BindText(3, msg.topic)
+	stmt.BindText(4, string(msg.payload))
+	stmt.BindInt64(5, int64(msg.qos))
 	var retained int64
-	if msg.Retained() {
+	if msg.retained {
 		retained = 1
 	}
-	vt.stmt.BindInt64(6, retained)
-	vt.stmt.BindText(7, time.Now().Format(time.RFC3339Nano))
-	_, err = vt.stmt.Step()
+	stmt.BindInt64(6, retained)
+	stmt.BindText(7, time.Now().Format(time.RFC3339Nano))
+	if vt.metadata {
+		vt.bindMetadata(stmt, msg)
+	}
+	_, err = stmt.Step()
 	if err != nil {
-		vt.logger.Error("insert data", "error", err, "topic", msg.Topic(), "client_id", clientOpts.ClientID(), "message_id", msg.MessageID())
+		vt.logger.Error("insert data", "error", err, "topic", msg.topic, "client_id", clientID, "message_id", msg.messageID)
+		return false
+	}
+	return true
+}
+
+// bindMetadata binds the metadata columns, NULL when the property is not present.
+func (vt *SubscriberVirtualTable) bindMetadata(stmt *sqlite.Stmt, msg *message) {
+	for i := 8; i <= 13; i++ {
+		stmt.BindNull(i)
+	}
+	stmt.BindBool(14, msg.duplicate)
+
+	props := msg.properties
+	if props == nil {
 		return
 	}
-	msg.Ack()
+	if len(props.user) > 0 {
+		user, err := formatUserProperties(props.user)
+		if err != nil {
+			vt.logger.Error("encode user properties", "error", err, "topic", msg.topic, "message_id", msg.messageID)
+		} else {
+			stmt.BindText(8, user)
+		}
+	}
+	if props.contentType != "" {
+		stmt.BindText(9, props.contentType)
+	}
+	if props.responseTopic != "" {
+		stmt.BindText(10, props.responseTopic)
+	}
+	if props.correlationData != nil {
+		stmt.BindBytes(11, props.correlationData)
+	}
+	if props.messageExpiry != nil {
+		stmt.BindInt64(12, int64(*props.messageExpiry))
+	}
+	if props.subscriptionIdentifier != nil {
+		stmt.BindInt64(13, int64(*props.subscriptionIdentifier))
+	}
 }
 
-func (vt *SubscriberVirtualTable) onConnectionLost(client mqtt.Client, err error) {
+func (vt *SubscriberVirtualTable) onConnectionLost(err error) {
+	vt.status.down(err)
 	vt.logger.Error("lost connection to the broker", "virtual_table", vt.virtualTableName, "error", err)
 }
 
-func (vt *SubscriberVirtualTable) onConnectHandler(client mqtt.Client) {
+func (vt *SubscriberVirtualTable) onConnectHandler() {
+	vt.status.up()
 	vt.logger.Debug("connected to broker", "virtual_table", vt.virtualTableName)
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
 	for _, subscription := range vt.subscriptions {
-		client.Subscribe(subscription.topic, subscription.qos, vt.messageHandler)
+		if err := vt.client.Subscribe(subscription.topic, subscription.qos, vt.messageHandler); err != nil {
+			vt.logger.Error("resubscribe", "virtual_table", vt.virtualTableName, "topic", subscription.topic, "error", err)
+		}
 	}
 }
 
-type subscriptionsCursor struct {
-	data    []subscription
-	current subscription // current row that the cursor points to
-	rowid   int64        // current rowid .. negative for EOF
+// sameTopic reports whether both subscriptions are to the same topic filter.
+func (s subscription) sameTopic(other subscription) bool {
+	return s.topic == other.topic
 }
 
-func newSubscriptionsCursor(data []subscription) *subscriptionsCursor {
-	slices.SortFunc(data, func(a, b subscription) int {
-		return cmp.Compare(a.topic, b.topic)
-	})
-	return &subscriptionsCursor{
-		data: data,
-	}
+// subscriptionRow is a subscription with the rowid of the shadow table.
+type subscriptionRow struct {
+	subscription
+	rowid int64
 }
 
-func (c *subscriptionsCursor) Next() error {
-	// EOF
-	if c.rowid < 0 || int(c.rowid) >= len(c.data) {
-		c.rowid = -1
-		return sqlite.SQLITE_OK
-	}
-	// slices are zero based
-	c.current = c.data[c.rowid]
-	c.rowid += 1
+type subscriptionsCursor struct {
+	data    []subscriptionRow
+	current int // index of the current row, len(data) at EOF
+}
 
+func (c *subscriptionsCursor) Next() error {
+	c.current++
 	return sqlite.SQLITE_OK
 }
 
 func (c *subscriptionsCursor) Column(ctx *sqlite.VirtualTableContext, i int) error {
 	switch i {
 	case 0:
-		ctx.ResultText(c.current.topic)
+		ctx.ResultText(c.data[c.current].topic)
 	case 1:
-		ctx.ResultInt(int(c.current.qos))
+		ctx.ResultInt(int(c.data[c.current].qos))
 	}
 	return nil
 }
 
 func (c *subscriptionsCursor) Filter(int, string, ...sqlite.Value) error {
-	c.rowid = 0
-	return c.Next()
+	c.current = 0
+	return sqlite.SQLITE_OK
 }
 
 func (c *subscriptionsCursor) Rowid() (int64, error) {
-	return c.rowid, nil
+	return c.data[c.current].rowid, nil
 }
 
 func (c *subscriptionsCursor) Eof() bool {
-	return c.rowid < 0
+	return c.current >= len(c.data)
 }
 
 func (c *subscriptionsCursor) Close() error {
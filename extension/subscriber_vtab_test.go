@@ -0,0 +1,329 @@
+package extension_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionTransactions(t *testing.T) {
+	s, addr := newBroker(t)
+	conn := openDB(t, "")
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://%s', client_id=subtx)", addr))
+
+	tests := []struct {
+		name  string
+		stmts []string
+		// want is the QoS of the subscription, -1 when not subscribed
+		want int
+	}{
+		{
+			name:  "autocommit",
+			stmts: []string{"INSERT INTO temp.sub VALUES(?1, 1)"},
+			want:  1,
+		},
+		{
+			name:  "commit",
+			stmts: []string{"BEGIN", "INSERT INTO temp.sub VALUES(?1, 2)", "COMMIT"},
+			want:  2,
+		},
+		{
+			name:  "rollback",
+			stmts: []string{"BEGIN", "INSERT INTO temp.sub VALUES(?1, 1)", "ROLLBACK"},
+			want:  -1,
+		},
+		{
+			name: "rollback to savepoint",
+			stmts: []string{
+				"BEGIN",
+				"SAVEPOINT sp",
+				"INSERT INTO temp.sub VALUES(?1, 1)",
+				"ROLLBACK TO sp",
+				"RELEASE sp",
+				"COMMIT",
+			},
+			want: -1,
+		},
+		{
+			name:  "delete",
+			stmts: []string{"INSERT INTO temp.sub VALUES(?1, 1)", "DELETE FROM temp.sub WHERE topic = ?1"},
+			want:  -1,
+		},
+		{
+			name: "delete rolled back",
+			stmts: []string{
+				"INSERT INTO temp.sub VALUES(?1, 1)",
+				"BEGIN",
+				"DELETE FROM temp.sub WHERE topic = ?1",
+				"ROLLBACK",
+			},
+			want: 1,
+		},
+		{
+			name: "qos change",
+			stmts: []string{
+				"INSERT INTO temp.sub VALUES(?1, 0)",
+				"BEGIN",
+				"DELETE FROM temp.sub WHERE topic = ?1",
+				"INSERT INTO temp.sub VALUES(?1, 2)",
+				"COMMIT",
+			},
+			want: 2,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := fmt.Sprintf("subtx/%d", i)
+			for _, stmt := range tt.stmts {
+				mustExec(t, conn, stmt, topic)
+			}
+			listed := -1
+			if n := queryInt(t, conn, "SELECT count(*) FROM temp.sub WHERE topic = ?", topic); n > 0 {
+				listed = queryInt(t, conn, "SELECT qos FROM temp.sub WHERE topic = ?", topic)
+			}
+			if listed != tt.want {
+				t.Errorf("listed with QoS %d, want %d", listed, tt.want)
+			}
+			subscribed := -1
+			if sub, ok := s.Topics.Subscribers(topic).Subscriptions["subtx"]; ok {
+				subscribed = int(sub.Qos)
+			}
+			if subscribed != tt.want {
+				t.Errorf("subscribed on the broker with QoS %d, want %d", subscribed, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionsShadowTable(t *testing.T) {
+	s, addr := newBroker(t)
+	file := filepath.Join(t.TempDir(), "sub.db")
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE main.sub USING mqtt_sub(servers='tcp://%s', client_id=shadow, topics='keep/#:1,drop/#')", addr))
+	mustExec(t, conn, "DELETE FROM main.sub WHERE topic = 'drop/#'")
+	if n := queryInt(t, conn, "SELECT count(*) FROM pragma_table_list WHERE name = 'sub_subscriptions' AND type = 'shadow'"); n != 1 {
+		t.Error("sub_subscriptions is not a shadow table")
+	}
+	conn.Close()
+	db.Close()
+	waitFor(t, "disconnection", func() bool { return clients(s) == 0 })
+
+	// the subscriptions are restored when the database is opened again
+	conn = openDB(t, file)
+	var topics []string
+	rows, err := conn.QueryContext(context.Background(), "SELECT topic FROM main.sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, topic)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"keep/#"}; !slices.Equal(topics, want) {
+		t.Errorf("restored %q, want %q", topics, want)
+	}
+	waitFor(t, "subscription", func() bool {
+		_, ok := s.Topics.Subscribers("keep/1").Subscriptions["shadow"]
+		return ok
+	})
+
+	mustExec(t, conn, "DROP TABLE main.sub")
+	if n := queryInt(t, conn, "SELECT count(*) FROM sqlite_master WHERE name = 'sub_subscriptions'"); n != 0 {
+		t.Error("sub_subscriptions not dropped with the virtual table")
+	}
+}
+
+func TestSubscriberBatchConnection(t *testing.T) {
+	s, addr := newBroker(t)
+	conn := openDB(t, filepath.Join(t.TempDir(), "batch.db"))
+	mustExec(t, conn, "PRAGMA journal_mode = WAL")
+	mustExec(t, conn, "CREATE TABLE app(n INTEGER)")
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://%s', client_id=batcher, topics='batch/#:1', table=batch_data, batch_size=10, batch_interval=10)", addr))
+	waitFor(t, "subscription", func() bool {
+		_, ok := s.Topics.Subscribers("batch/1").Subscriptions["batcher"]
+		return ok
+	})
+
+	const messages = 200
+	go func() {
+		for i := range messages {
+			_ = s.Publish(fmt.Sprintf("batch/%d", i), []byte("x"), false, 1)
+		}
+	}()
+	// the batches are committed by a connection of their own: they neither
+	// start transactions on the connection of the application nor join its ones
+	for range 100 {
+		mustExec(t, conn, "BEGIN")
+		mustExec(t, conn, "INSERT INTO app VALUES(1)")
+		mustExec(t, conn, "ROLLBACK")
+	}
+	waitFor(t, "messages", func() bool {
+		return queryInt(t, conn, "SELECT count(*) FROM batch_data") == messages
+	})
+	if n := queryInt(t, conn, "SELECT count(*) FROM app"); n != 0 {
+		t.Errorf("%d rows of rolled back transactions, want 0", n)
+	}
+}
+
+func TestSubscriberBatchRequiresFile(t *testing.T) {
+	_, addr := newBroker(t)
+	conn := openDB(t, "")
+	for _, option := range []string{"batch_size=10", "batch_interval=100", "ack=after_commit"} {
+		t.Run(option, func(t *testing.T) {
+			_, err := conn.ExecContext(context.Background(), fmt.Sprintf("CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://%s', %s)", addr, option))
+			if err == nil || !strings.Contains(err.Error(), "not stored in a file") {
+				t.Errorf("got error %v, want the table to require a database file", err)
+			}
+		})
+	}
+}
+
+func TestSubscriberCloseDuringFlood(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+	}{
+		{name: "plain"},
+		{name: "queue", options: ", queue_size=10"},
+		{name: "batch", options: ", batch_size=50"},
+		{name: "after commit", options: ", ack=after_commit"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := newBroker(t)
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "flood.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientID := fmt.Sprintf("flood%d", i)
+			mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://%s', client_id=%s, topics='flood/#:1'%s)", addr, clientID, tt.options))
+			waitFor(t, "subscription", func() bool {
+				_, ok := s.Topics.Subscribers("flood/1").Subscriptions[clientID]
+				return ok
+			})
+
+			stop := make(chan struct{})
+			published := make(chan struct{})
+			go func() {
+				defer close(published)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						_ = s.Publish("flood/1", []byte("x"), false, 1)
+					}
+				}
+			}()
+			defer func() {
+				close(stop)
+				<-published
+			}()
+			waitFor(t, "messages", func() bool {
+				return queryInt(t, conn, "SELECT count(*) FROM mqtt_data") > 0
+			})
+
+			// closing unsubscribes while the client keeps delivering messages
+			closed := make(chan error, 1)
+			go func() { closed <- conn.Close() }()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("closing the connection did not return")
+			}
+		})
+	}
+}
+
+func TestSubscriberOverlappingFilters(t *testing.T) {
+	s, addr := newBroker(t)
+	conn := openDB(t, "")
+	// the broker sends a single copy of the messages matching both filters,
+	// routed by its subscription identifier
+	mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://%s', client_id=overlap, protocol_version=5, topics='overlap/#,overlap/+')", addr))
+	waitFor(t, "subscriptions", func() bool {
+		return len(s.Topics.Subscribers("overlap/1").Subscriptions) == 1
+	})
+
+	for _, topic := range []string{"overlap/1", "overlap/1/2", "overlap/end"} {
+		if err := s.Publish(topic, []byte("x"), false, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "messages", func() bool {
+		return queryInt(t, conn, "SELECT count(*) FROM mqtt_data WHERE topic = 'overlap/end'") > 0
+	})
+	if n := queryInt(t, conn, "SELECT count(*) FROM mqtt_data"); n != 3 {
+		t.Errorf("%d messages stored, want 3", n)
+	}
+}
+
+func TestSubscriberOptionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		err     string
+	}{
+		{
+			name:    "unsupported ack mode",
+			options: "ack=manual",
+			err:     `invalid "ack" option: unsupported mode "manual", use auto or after_commit`,
+		},
+		{
+			name:    "unsupported overflow policy",
+			options: "queue_size=10, overflow=drop",
+			err:     `invalid "overflow" option: unsupported policy "drop", use block, drop_oldest, drop_newest or spill_to_disk`,
+		},
+		{
+			name:    "overflow without queue",
+			options: "overflow=drop_oldest",
+			err:     `"overflow" requires "queue_size"`,
+		},
+		{
+			name:    "negative queue size",
+			options: "queue_size=-1",
+			err:     `invalid "queue_size" option: must be a positive number`,
+		},
+		{
+			name:    "invalid topics",
+			options: "topics='a:3'",
+			err:     `invalid "topics" option: QoS must be the number 0, 1 or 2`,
+		},
+	}
+	conn := openDB(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := conn.ExecContext(context.Background(), "CREATE VIRTUAL TABLE temp.sub USING mqtt_sub(servers='tcp://127.0.0.1:1883', "+tt.options+")")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package extension
+
+import (
+	"cmp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// lastConnID numbers the database connections loading the extension, so that the
+// virtual tables of a connection are told apart from the ones with the same name
+// on other connections of the process.
+var lastConnID atomic.Uint64
+
+// tableID identifies a connected virtual table in the process.
+type tableID struct {
+	conn   uint64
+	schema string
+	name   string
+}
+
+// schemaOrder is the order SQLite searches the schemas for an unqualified table name.
+func schemaOrder(schema string) int {
+	switch strings.ToLower(schema) {
+	case "temp":
+		return 0
+	case "main":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// compareSchemas orders the schemas the way SQLite searches them.
+func compareSchemas(a, b string) int {
+	return cmp.Or(cmp.Compare(schemaOrder(a), schemaOrder(b)), cmp.Compare(a, b))
+}
+
+// tableRegistry holds the connected virtual tables of a module, so that the SQL
+// functions can find them by name. Every instance is registered on its own, a
+// table connected again before the previous instance disconnects included.
+type tableRegistry[T comparable] struct {
+	mu     sync.RWMutex
+	tables map[T]tableID
+}
+
+func (r *tableRegistry[T]) add(vt T, id tableID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tables == nil {
+		r.tables = make(map[T]tableID)
+	}
+	r.tables[vt] = id
+}
+
+func (r *tableRegistry[T]) remove(vt T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tables, vt)
+}
+
+// lookup returns the virtual table of the connection named by name, optionally
+// qualified by its schema, like main.sensors. Like SQLite, an unqualified name
+// is searched in temp, then main, then the attached databases.
+func (r *tableRegistry[T]) lookup(conn uint64, name string) (T, tableID, bool) {
+	schema, table, qualified := strings.Cut(name, ".")
+	if !qualified {
+		table = name
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var (
+		found   T
+		foundID tableID
+		ok      bool
+	)
+	for vt, id := range r.tables {
+		if id.conn != conn || !strings.EqualFold(id.name, table) {
+			continue
+		}
+		if qualified && !strings.EqualFold(id.schema, schema) {
+			continue
+		}
+		if !ok || compareSchemas(id.schema, foundID.schema) < 0 {
+			found, foundID, ok = vt, id, true
+		}
+	}
+	return found, foundID, ok
+}
+
+// each calls fn for every registered virtual table.
+func (r *tableRegistry[T]) each(fn func(vt T, id tableID)) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for vt, id := range r.tables {
+		fn(vt, id)
+	}
+}
@@ -0,0 +1,355 @@
+package extension
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/walterwanderley/sqlite"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// tlsSettings are the TLS options of a connection.
+type tlsSettings struct {
+	certFile        string
+	certPEM         []byte
+	certKeyFile     string
+	certKeyPEM      []byte
+	keyPassword     string
+	keyPasswordFile *secretFile
+	caFile          string
+	caPEM           []byte
+	insecure        bool
+	minVersion      uint16
+	cipherSuites    []uint16
+	serverName      string
+	alpn            []string
+}
+
+// config returns the TLS configuration of the connection and the loader of the
+// client certificate, nil without one.
+func (s tlsSettings) config() (*tls.Config, *certLoader, error) {
+	tlsConfig := tls.Config{
+		InsecureSkipVerify: s.insecure,
+		MinVersion:         s.minVersion,
+		CipherSuites:       s.cipherSuites,
+		ServerName:         s.serverName,
+		NextProtos:         s.alpn,
+	}
+
+	var certs *certLoader
+	if s.certFile != "" || s.certPEM != nil {
+		certs = &certLoader{settings: s}
+		if _, err := certs.load(); err != nil {
+			return nil, nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.load()
+		}
+	}
+
+	if s.caFile != "" || s.caPEM != nil {
+		caCertPEM := s.caPEM
+		if caCertPEM == nil {
+			var err error
+			caCertPEM, err = os.ReadFile(s.caFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error loading CA certificate: %w", err)
+			}
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCertPEM) {
+			return nil, nil, fmt.Errorf("error appending CA certificate to pool")
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return &tlsConfig, certs, nil
+}
+
+// certLoader loads the client certificate on every TLS handshake, reading the
+// files again when they change on disk, so a renewed certificate is presented
+// on the next connection without recreating the virtual table.
+type certLoader struct {
+	settings tlsSettings
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	// version identifies the files, and the password, of cert
+	version string
+}
+
+func (l *certLoader) load() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	version, err := l.settings.version()
+	if err == nil && version == l.version {
+		return l.cert, nil
+	}
+	cert, err := l.settings.clientCertificate()
+	if err != nil {
+		if l.cert != nil {
+			// the files may be half written, keep the current certificate
+			// until the renewal is complete
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.cert, l.version = cert, version
+	return cert, nil
+}
+
+// leaf returns the last certificate loaded, nil without a client certificate.
+func (l *certLoader) leaf() *x509.Certificate {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cert == nil {
+		return nil
+	}
+	return l.cert.Leaf
+}
+
+// version changes whenever the certificate or key files, or the password, change.
+func (s tlsSettings) version() (string, error) {
+	var version strings.Builder
+	for _, name := range []string{s.certFile, s.certKeyFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%s:%d:%d;", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	password, err := s.password()
+	if err != nil {
+		return "", err
+	}
+	version.WriteString(password)
+	return version.String(), nil
+}
+
+func (s tlsSettings) password() (string, error) {
+	if s.keyPasswordFile != nil {
+		return s.keyPasswordFile.read()
+	}
+	return s.keyPassword, nil
+}
+
+// clientCertificate loads the certificate and its key. A certificate file
+// without PEM data is read as a PKCS#12 bundle, holding the key too.
+func (s tlsSettings) clientCertificate() (*tls.Certificate, error) {
+	var err error
+	certData := s.certPEM
+	if certData == nil {
+		certData, err = os.ReadFile(s.certFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	password, err := s.password()
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(certData); block == nil {
+		return loadPKCS12(certData, password)
+	}
+
+	keyPEM := s.certKeyPEM
+	if keyPEM == nil {
+		if s.certKeyFile == "" {
+			return nil, errors.New("a PEM certificate requires the certificate key")
+		}
+		keyPEM, err = os.ReadFile(s.certKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyPEM, err = decryptKey(keyPEM, password)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certData, keyPEM)
+	return &cert, err
+}
+
+// decryptKey decrypts a PEM key encrypted with a password, either PKCS#8 or
+// with the Proc-Type: 4,ENCRYPTED header. Unencrypted keys are returned unchanged.
+func decryptKey(keyPEM []byte, password string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM data found in the certificate key")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("decrypting the certificate key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	// x509 deprecates the legacy PEM encryption, but openssl still produces it
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	der, err := x509.DecryptPEMBlock(block, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the certificate key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// loadPKCS12 reads the key, the certificate and its chain from a PKCS#12 bundle.
+func loadPKCS12(data []byte, password string) (*tls.Certificate, error) {
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the PKCS#12 bundle: %w", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return &cert, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported version %q, use 1.0, 1.1, 1.2 or 1.3", v)
+	}
+}
+
+// parseCipherSuites returns the IDs of a comma-separated list of cipher suite
+// names. The TLS 1.3 suites are not configurable in crypto/tls.
+func parseCipherSuites(v string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs
+	}
+	var ids []uint16
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		cs, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %q is TLS 1.3 only and can't be configured", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+// loadCertFrom returns the options of a virtual table, with the TLS material of
+// the cert_from='table:name' option read from a row of the table. The cert_pem,
+// cert_key_pem, ca_pem and cert_key_password columns are options, the other
+// columns and NULL values are skipped. DER blobs are converted to PEM. Options
+// given inline, and their file counterparts, override the ones of the row.
+func loadCertFrom(conn *sqlite.Conn, opts []string) ([]string, error) {
+	var (
+		certFrom string
+		inline   = make([]string, 0, len(opts))
+		keys     = make(map[string]bool)
+	)
+	for _, opt := range opts {
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok {
+			// reported by the option parser
+			inline = append(inline, opt)
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k == config.CertFrom {
+			certFrom = sanitizeOptionValue(v)
+			continue
+		}
+		keys[k] = true
+		inline = append(inline, opt)
+	}
+	if certFrom == "" {
+		return inline, nil
+	}
+	table, name, ok := strings.Cut(certFrom, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid %q option: %q is not table:name", config.CertFrom, certFrom)
+	}
+	if !tableNameValid(table) {
+		return nil, fmt.Errorf("table name %q is invalid", table)
+	}
+
+	var (
+		found    bool
+		settings []string
+	)
+	err := conn.Exec(fmt.Sprintf("SELECT * FROM %s WHERE name = ?", table), func(stmt *sqlite.Stmt) error {
+		found = true
+		for i := range stmt.ColumnCount() {
+			k := strings.ToLower(stmt.ColumnName(i))
+			// the inline file options override the columns too
+			var blockType, fileOption string
+			switch k {
+			case config.CertPEM:
+				blockType, fileOption = "CERTIFICATE", config.CertFile
+			case config.CAPEM:
+				blockType, fileOption = "CERTIFICATE", config.CertCAFile
+			case config.CertKeyPEM:
+				blockType, fileOption = "PRIVATE KEY", config.CertKeyFile
+			case config.CertKeyPassword:
+				fileOption = config.CertKeyPasswordFile
+			default:
+				continue
+			}
+			if keys[k] || keys[fileOption] || stmt.ColumnType(i) == sqlite.SQLITE_NULL {
+				continue
+			}
+			data := make([]byte, stmt.ColumnLen(i))
+			stmt.ColumnBytes(i, data)
+			if block, _ := pem.Decode(data); block == nil && blockType != "" && stmt.ColumnType(i) == sqlite.SQLITE_BLOB {
+				data = pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})
+			}
+			// the values are taken literally, not expanded like the inline ones
+			settings = append(settings, k+"="+strings.ReplaceAll(string(data), "$", "$$"))
+		}
+		return nil
+	}, name)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %q from %s: %w", name, table, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("certificate %q not found in %s", name, table)
+	}
+	return append(settings, inline...), nil
+}
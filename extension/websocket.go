@@ -0,0 +1,94 @@
+package extension
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// wsSettings are the options of the ws:// and wss:// servers.
+type wsSettings struct {
+	headers http.Header
+	proxy   *url.URL
+}
+
+// set parses the value of a websocket option. It returns false if the key is not a websocket option.
+func (ws *wsSettings) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case config.WSHeaders:
+		ws.headers, err = parseHeaders(value)
+	case config.HTTPProxy:
+		ws.proxy, err = parseProxy(value, "http", "https")
+	case config.SOCKS5Proxy:
+		ws.proxy, err = parseProxy(value, "socks5")
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid %q option: %w", key, err)
+	}
+	return true, nil
+}
+
+// parseProxy parses the URL of a proxy, the first scheme is the default.
+func parseProxy(value string, schemes ...string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = schemes[0] + "://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a %s proxy URL", u.Redacted(), strings.Join(schemes, " or "))
+	}
+	return u, nil
+}
+
+// parseHeaders parses a JSON object, like the user properties, into HTTP headers.
+func parseHeaders(s string) (http.Header, error) {
+	props, err := parseUserProperties(s)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(http.Header, len(props))
+	for _, p := range props {
+		headers.Add(p.key, p.value)
+	}
+	return headers, nil
+}
+
+// apply sets the websocket options on the client options, shared by the MQTT 3.1.1
+// and MQTT 5 clients. The websocket options only apply to ws:// and wss:// servers.
+func (ws *wsSettings) apply(opts *mqtt.ClientOptions) error {
+	if ws.headers == nil && ws.proxy == nil {
+		return nil
+	}
+	if len(opts.Servers) > 0 && !slices.ContainsFunc(opts.Servers, isWebsocket) {
+		return fmt.Errorf("the websocket options require a ws:// or wss:// server")
+	}
+	if ws.headers != nil {
+		opts.SetHTTPHeaders(ws.headers)
+	}
+	if ws.proxy != nil {
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{
+			Proxy: http.ProxyURL(ws.proxy),
+		})
+	}
+	return nil
+}
+
+func isWebsocket(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "ws", "wss":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package extension_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// proxyLog records what the proxies in front of the broker see.
+type proxyLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *proxyLog) add(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *proxyLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.entries)
+}
+
+// pipe copies the data between the connections until one of them is closed.
+func pipe(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// wsFrontend starts a reverse proxy to the WebSocket listener of the broker,
+// logging the X-Device header of the handshakes.
+func wsFrontend(t *testing.T, target string, log *proxyLog) string {
+	t.Helper()
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if device := r.Header.Get("X-Device"); device != "" {
+			log.add("header " + device)
+		}
+		rp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// httpProxy starts an HTTP proxy tunneling the CONNECT requests.
+func httpProxy(t *testing.T, log *proxyLog) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		log.add("connect " + r.Host)
+		if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+			log.add("auth " + auth)
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		pipe(conn, upstream)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// socks5Proxy starts a SOCKS5 proxy without authentication.
+func socks5Proxy(t *testing.T, log *proxyLog) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, log)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveSOCKS5 handles the CONNECT command of RFC 1928.
+func serveSOCKS5(conn net.Conn, log *proxyLog) {
+	buf := make([]byte, 256)
+	read := func(n int) []byte {
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	// version and authentication methods
+	if b := read(2); b == nil || b[0] != 5 || read(int(b[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0})
+	// version, command, reserved and address type
+	b := read(4)
+	if b == nil || b[1] != 1 {
+		conn.Close()
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		if n := read(1); n != nil {
+			host = string(read(int(n[0])))
+		}
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	port := read(2)
+	if port == nil {
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	log.add("socks5 " + target)
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+func TestWebsocket(t *testing.T) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	tests := []struct {
+		name string
+		// options of the virtual table, with {ws}, {front}, {http} and {socks5}
+		// replaced by the address of the broker and of the proxies
+		options string
+		want    []string
+	}{
+		{
+			name:    "headers",
+			options: `servers='ws://{front}/mqtt', ws_headers='{"X-Device":"42"}'`,
+			want:    []string{"header 42"},
+		},
+		{
+			name:    "http proxy",
+			options: `servers='ws://{ws}/mqtt', http_proxy='http://{http}'`,
+			want:    []string{"connect {ws}"},
+		},
+		{
+			name:    "http proxy credentials",
+			options: `servers='ws://{ws}/mqtt', http_proxy='http://user:secret@{http}'`,
+			want:    []string{"connect {ws}", "auth " + basic},
+		},
+		{
+			name:    "socks5 proxy",
+			options: `servers='ws://{ws}/mqtt', socks5_proxy='{socks5}'`,
+			want:    []string{"socks5 {ws}"},
+		},
+		{
+			name:    "headers through a proxy",
+			options: `servers='ws://{front}/mqtt', ws_headers='{"X-Device":"7"}', http_proxy='{http}'`,
+			want:    []string{"connect {front}", "header 7"},
+		},
+	}
+	for _, version := range []string{"4", "5"} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s mqtt%s", tt.name, version), func(t *testing.T) {
+				ws := freeAddr(t)
+				s := startBroker(t, listeners.NewWebsocket(listeners.Config{ID: "ws", Address: ws}))
+				r := record(t, s, "ws/#")
+				var log proxyLog
+				addrs := strings.NewReplacer(
+					"{ws}", ws,
+					"{front}", wsFrontend(t, ws, &log),
+					"{http}", httpProxy(t, &log),
+					"{socks5}", socks5Proxy(t, &log),
+				)
+				conn := openDB(t, "")
+
+				mustExec(t, conn, fmt.Sprintf("CREATE VIRTUAL TABLE temp.pub USING mqtt_pub(%s, protocol_version=%s)", addrs.Replace(tt.options), version))
+				mustExec(t, conn, "INSERT INTO temp.pub(topic, payload) VALUES('ws/1', 'hello')")
+				r.waitUntil(t, "hello")
+				for _, want := range tt.want {
+					if want := addrs.Replace(want); !slices.Contains(log.list(), want) {
+						t.Errorf("proxy log %q, want %q", log.list(), want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWebsocketOptionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		err     string
+	}{
+		{
+			name:    "tcp server",
+			options: `servers='tcp://127.0.0.1:1883', ws_headers='{"X-Device":"42"}'`,
+			err:     "the websocket options require a ws:// or wss:// server",
+		},
+		{
+			name:    "two proxies",
+			options: `servers='ws://127.0.0.1:8080/mqtt', http_proxy='proxy:3128', socks5_proxy='proxy:1080'`,
+			err:     `options "http_proxy" and "socks5_proxy" are mutually exclusive`,
+		},
+		{
+			name:    "proxy scheme",
+			options: `servers='ws://127.0.0.1:8080/mqtt', socks5_proxy='http://proxy:1080'`,
+			err:     `invalid "socks5_proxy" option`,
+		},
+	}
+	conn := openDB(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := conn.ExecContext(context.Background(), "CREATE VIRTUAL TABLE temp.pub USING mqtt_pub("+tt.options+")")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package extension
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/litesql/mqtt/config"
+)
+
+// will is the Last Will and Testament published by the broker when the client
+// drops without disconnecting, and the optional birth message published to the
+// same topic on every connection.
+type will struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+
+	// MQTT 5 only
+	delay      *uint32
+	properties []userProperty
+
+	birthPayload []byte
+}
+
+// set parses the value of a will option. It returns false if the key is not a will option.
+func (w *will) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case config.WillTopic:
+		w.topic = value
+	case config.WillPayload:
+		w.payload = []byte(value)
+	case config.WillQoS:
+		var qos int
+		qos, err = strconv.Atoi(value)
+		if err == nil && (qos < 0 || qos > 2) {
+			err = fmt.Errorf("QoS must be the number 0, 1 or 2")
+		}
+		w.qos = byte(qos)
+	case config.WillRetained:
+		w.retained, err = strconv.ParseBool(value)
+	case config.WillDelay:
+		var delay uint32
+		delay, err = parseSessionExpiry(value)
+		w.delay = &delay
+	case config.WillProperties:
+		w.properties, err = parseUserProperties(value)
+	case config.BirthPayload:
+		w.birthPayload = []byte(value)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("invalid %q option: %w", key, err)
+	}
+	return true, nil
+}
+
+// config returns the will to set on the client, nil if no will option was used.
+func (w *will) config() (*will, error) {
+	if w.topic == "" {
+		if w.payload != nil || w.qos > 0 || w.retained || w.delay != nil || w.properties != nil || w.birthPayload != nil {
+			return nil, fmt.Errorf("%q is required by the will options", config.WillTopic)
+		}
+		return nil, nil
+	}
+	return w, nil
+}
+
+// birth returns the message announcing the connection, or nil without birth_payload.
+func (w *will) birth() *message {
+	if w == nil || w.birthPayload == nil {
+		return nil
+	}
+	return &message{
+		topic:    w.topic,
+		payload:  w.birthPayload,
+		qos:      w.qos,
+		retained: w.retained,
+	}
+}
+
+// publishBirth is called from the connect handlers of the virtual tables.
+func publishBirth(c client, w *will, logger *slog.Logger, virtualTableName string) {
+	msg := w.birth()
+	if msg == nil {
+		return
+	}
+	if err := c.Publish(msg); err != nil {
+		logger.Error("publish birth message", "virtual_table", virtualTableName, "topic", msg.topic, "error", err)
+	}
+}
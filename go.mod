@@ -1,15 +1,23 @@
 module github.com/litesql/mqtt
 
-go 1.24
+go 1.24.0
 
 require (
+	github.com/eclipse/paho.golang v0.23.0
 	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-pointer v0.0.1
+	github.com/mattn/go-sqlite3 v1.14.29
+	github.com/mochi-mqtt/server/v2 v2.7.9
 	github.com/walterwanderley/sqlite v0.0.0-20250807085442-1c89b916e683
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/mattn/go-pointer v0.0.1 // indirect
-	golang.org/x/net v0.36.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )